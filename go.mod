@@ -32,6 +32,7 @@ require (
 	github.com/container-storage-interface/spec v1.2.0
 	github.com/davecgh/go-spew v1.1.1
 	github.com/go-resty/resty v1.12.0 // indirect
+	github.com/golang/protobuf v1.3.2
 	github.com/inspur-ics/ics-go-sdk v1.0.3
 	github.com/rexray/gocsi v1.1.0
 	google.golang.org/grpc v1.26.0
@@ -38,6 +38,24 @@ const (
 	DefaultCloudConfigPath = "/etc/ics/icsphere-csi.conf"
 	// EnvCloudConfig contains the path to the CSI vSphere Config
 	EnvCloudConfig = "ICSPHERE_CSI_CONFIG"
+	// PlacementFreeSpace selects the datastore with the most free space.
+	PlacementFreeSpace = "freespace"
+	// PlacementUsage selects the datastore with the lowest used percentage.
+	PlacementUsage = "usage"
+	// PlacementRoundRobin selects the datastores in turn.
+	PlacementRoundRobin = "roundrobin"
+	// DefaultDatastorePlacement is the default datastore placement strategy.
+	DefaultDatastorePlacement = PlacementFreeSpace
+	// DefaultVolumeSizeGranularityMB rounds volume sizes up to whole GiB.
+	DefaultVolumeSizeGranularityMB = 1024
+	// MultiAttachReject refuses to attach volumes attached to another node.
+	MultiAttachReject = "reject"
+	// MultiAttachForceDetach detaches volumes from other nodes which are NotReady or deleted.
+	MultiAttachForceDetach = "force-detach"
+	// DefaultMultiAttachPolicy is the default multi-attach policy.
+	DefaultMultiAttachPolicy = MultiAttachReject
+	// DefaultOperationTimeout is the default timeout in seconds of volume operations.
+	DefaultOperationTimeout = 300
 )
 
 // Errors
@@ -55,6 +73,26 @@ var (
 	// ErrMissingVCenter is returned when the provided configuration does not
 	// define any vCenters.
 	ErrMissingVCenter = errors.New("No iCenter hosts defined")
+
+	// ErrInvalidDatastorePlacement is returned when the provided datastore
+	// placement strategy is not supported.
+	ErrInvalidDatastorePlacement = errors.New("Invalid datastore-placement, supported values are freespace, usage and roundrobin")
+
+	// ErrInvalidDatastoreReserve is returned when the provided datastore
+	// free-space reserve is not a percentage.
+	ErrInvalidDatastoreReserve = errors.New("Invalid datastore-reserve-percent, must be between 0 and 99")
+
+	// ErrInvalidVolumeSizeGranularity is returned when the provided volume
+	// size granularity is negative.
+	ErrInvalidVolumeSizeGranularity = errors.New("Invalid volume-size-granularity-mb, must not be negative")
+
+	// ErrInvalidMultiAttachPolicy is returned when the provided multi-attach
+	// policy is not supported.
+	ErrInvalidMultiAttachPolicy = errors.New("Invalid multi-attach-policy, supported values are reject and force-detach")
+
+	// ErrInvalidOperationTimeout is returned when the provided timeout of a
+	// volume operation is negative.
+	ErrInvalidOperationTimeout = errors.New("Invalid operation timeout, must not be negative")
 )
 
 func getEnvKeyValue(match string, partial bool) (string, string, error) {
@@ -121,6 +159,48 @@ func FromEnv(cfg *Config) error {
 			cfg.Global.InsecureFlag = InsecureFlag
 		}
 	}
+	if v := os.Getenv("ICS_DATASTORE_PLACEMENT"); v != "" {
+		cfg.Global.DatastorePlacement = v
+	}
+	if v := os.Getenv("ICS_DATASTORES"); v != "" {
+		cfg.Global.Datastores = v
+	}
+	if v := os.Getenv("ICS_DATASTORE_RESERVE_PERCENT"); v != "" {
+		reservePercent, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Errorf("Failed to parse ICS_DATASTORE_RESERVE_PERCENT: %s", err)
+		} else {
+			cfg.Global.DatastoreReservePercent = reservePercent
+		}
+	}
+	if v := os.Getenv("ICS_VOLUME_SIZE_GRANULARITY_MB"); v != "" {
+		granularityMB, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Errorf("Failed to parse ICS_VOLUME_SIZE_GRANULARITY_MB: %s", err)
+		} else {
+			cfg.Global.VolumeSizeGranularityMB = granularityMB
+		}
+	}
+	if v := os.Getenv("ICS_MULTI_ATTACH_POLICY"); v != "" {
+		cfg.Global.MultiAttachPolicy = v
+	}
+	if v := os.Getenv("ICS_TASK_STORE_CONFIGMAP"); v != "" {
+		cfg.Global.TaskStoreConfigMap = v
+	}
+	if v := os.Getenv("ICS_METRICS_ADDRESS"); v != "" {
+		cfg.Global.MetricsAddress = v
+	}
+	for operation, timeout := range getOperationTimeouts(cfg) {
+		env := "ICS_" + strings.ToUpper(operation) + "_TIMEOUT"
+		if v := os.Getenv(env); v != "" {
+			seconds, err := strconv.Atoi(v)
+			if err != nil {
+				klog.Errorf("Failed to parse %s: %s", env, err)
+			} else {
+				*timeout = seconds
+			}
+		}
+	}
 	if v := os.Getenv("ICS_LABEL_REGION"); v != "" {
 		cfg.Labels.Region = v
 	}
@@ -192,11 +272,60 @@ func FromEnv(cfg *Config) error {
 	return nil
 }
 
+// getOperationTimeouts returns the timeouts of the volume operations keyed by operation.
+func getOperationTimeouts(cfg *Config) map[string]*int {
+	return map[string]*int{
+		"create": &cfg.Global.CreateTimeout,
+		"attach": &cfg.Global.AttachTimeout,
+		"detach": &cfg.Global.DetachTimeout,
+		"expand": &cfg.Global.ExpandTimeout,
+		"delete": &cfg.Global.DeleteTimeout,
+	}
+}
+
 func validateConfig(cfg *Config) error {
 	//Fix default global values
 	if cfg.Global.VCenterPort == "" {
 		cfg.Global.VCenterPort = DefaultVCenterPort
 	}
+	cfg.Global.DatastorePlacement = strings.ToLower(strings.TrimSpace(cfg.Global.DatastorePlacement))
+	switch cfg.Global.DatastorePlacement {
+	case "":
+		cfg.Global.DatastorePlacement = DefaultDatastorePlacement
+	case PlacementFreeSpace, PlacementUsage, PlacementRoundRobin:
+	default:
+		klog.Errorf("Invalid datastore-placement %q", cfg.Global.DatastorePlacement)
+		return ErrInvalidDatastorePlacement
+	}
+	if cfg.Global.DatastoreReservePercent < 0 || cfg.Global.DatastoreReservePercent >= 100 {
+		klog.Errorf("Invalid datastore-reserve-percent %d", cfg.Global.DatastoreReservePercent)
+		return ErrInvalidDatastoreReserve
+	}
+	if cfg.Global.VolumeSizeGranularityMB < 0 {
+		klog.Errorf("Invalid volume-size-granularity-mb %d", cfg.Global.VolumeSizeGranularityMB)
+		return ErrInvalidVolumeSizeGranularity
+	}
+	if cfg.Global.VolumeSizeGranularityMB == 0 {
+		cfg.Global.VolumeSizeGranularityMB = DefaultVolumeSizeGranularityMB
+	}
+	cfg.Global.MultiAttachPolicy = strings.ToLower(strings.TrimSpace(cfg.Global.MultiAttachPolicy))
+	switch cfg.Global.MultiAttachPolicy {
+	case "":
+		cfg.Global.MultiAttachPolicy = DefaultMultiAttachPolicy
+	case MultiAttachReject, MultiAttachForceDetach:
+	default:
+		klog.Errorf("Invalid multi-attach-policy %q", cfg.Global.MultiAttachPolicy)
+		return ErrInvalidMultiAttachPolicy
+	}
+	for operation, timeout := range getOperationTimeouts(cfg) {
+		if *timeout < 0 {
+			klog.Errorf("Invalid %s-timeout %d", operation, *timeout)
+			return ErrInvalidOperationTimeout
+		}
+		if *timeout == 0 {
+			*timeout = DefaultOperationTimeout
+		}
+	}
 	// Must have at least one vCenter defined
 	if len(cfg.VirtualCenter) == 0 {
 		klog.Error(ErrMissingVCenter)
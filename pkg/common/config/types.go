@@ -38,6 +38,36 @@ type Config struct {
 		CAFile string `gcfg:"ca-file"`
 		// Datacenter in which Node VMs are located.
 		Datacenters string `gcfg:"datacenters"`
+		// Strategy to select a datastore when the Storage Class does not specify one:
+		// "freespace" (default), "usage" or "roundrobin".
+		DatastorePlacement string `gcfg:"datastore-placement"`
+		// Comma separated names or IDs of datastores to select from when the
+		// Storage Class does not specify one. All shared datastores are used if empty.
+		Datastores string `gcfg:"datastores"`
+		// Percentage of the capacity of each datastore kept free when placing volumes.
+		DatastoreReservePercent int `gcfg:"datastore-reserve-percent"`
+		// Volume sizes are rounded up to a multiple of this many MiB, 1024 by default.
+		// Set it below 1024 only if iCenter accepts fractional GiB volume sizes.
+		VolumeSizeGranularityMB int `gcfg:"volume-size-granularity-mb"`
+		// Action when a volume being attached is still attached to another node:
+		// "reject" (default) or "force-detach", which detaches it from the other
+		// node only if that node is NotReady or deleted in Kubernetes.
+		MultiAttachPolicy string `gcfg:"multi-attach-policy"`
+		// Timeouts in seconds of the create, attach, detach, expand and delete
+		// volume operations, 300 by default. The deadline of the request applies too.
+		CreateTimeout int `gcfg:"create-timeout"`
+		AttachTimeout int `gcfg:"attach-timeout"`
+		DetachTimeout int `gcfg:"detach-timeout"`
+		ExpandTimeout int `gcfg:"expand-timeout"`
+		DeleteTimeout int `gcfg:"delete-timeout"`
+		// Name of the ConfigMap, in the namespace of the controller, the in-flight
+		// iCenter tasks are recorded in, so that operations retried after the
+		// controller restarts on any node resume their tasks. The tasks are
+		// recorded in memory only if empty.
+		TaskStoreConfigMap string `gcfg:"task-store-configmap"`
+		// Address the controller serves its metrics on at /debug/vars, like the
+		// iCenter login and session reuse counts. Metrics are not served if empty.
+		MetricsAddress string `gcfg:"metrics-address"`
 	}
 
 	// Virtual Center configurations
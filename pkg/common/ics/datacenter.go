@@ -19,6 +19,7 @@ package ics
 import (
 	"context"
 	"fmt"
+	"github.com/inspur-ics/ics-go-sdk/client"
 	"github.com/inspur-ics/ics-go-sdk/client/types"
 	icsdc "github.com/inspur-ics/ics-go-sdk/datacenter"
 	"k8s.io/klog"
@@ -42,10 +43,7 @@ func (dc *Datacenter) String() string {
 
 // Renew renews the datacenter information. If reconnect is
 // set to true, the virtual center connection is also renewed.
-func (dc *Datacenter) Renew(reconnect bool) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
+func (dc *Datacenter) Renew(ctx context.Context, reconnect bool) error {
 	vc, err := GetVirtualCenterManager().GetVirtualCenter(dc.VirtualCenterHost)
 	if err != nil {
 		klog.Errorf("Failed to get VC while renewing datacenter %v with err: %v", dc, err)
@@ -59,13 +57,18 @@ func (dc *Datacenter) Renew(reconnect bool) error {
 		}
 	}
 
-	dcService := icsdc.NewDatacenterService(vc.Client)
-	dcinfo, err := dcService.GetDatacenter(ctx, dc.ID)
+	err = vc.withSession(ctx, func(c *client.Client) error {
+		dcinfo, err := icsdc.NewDatacenterService(c).GetDatacenter(ctx, dc.ID)
+		if err != nil {
+			return err
+		}
+		dc.Datacenter = dcinfo
+		return nil
+	})
 	if err != nil {
 		klog.Errorf("Failed to renew datacenter %s info with err: %v", dc.Datacenter.Name, err)
 		return err
 	}
-	dc.Datacenter = dcinfo
 	return nil
 }
 
@@ -79,8 +82,7 @@ func (dc *Datacenter) GetVirtualMachineByUUID(ctx context.Context, hostname stri
 		return nil, err
 	}
 
-	dcService := icsdc.NewDatacenterService(vc.Client)
-	vmList, err := dcService.GetDatacenterVMList(ctx, dc.Datacenter.ID)
+	vmList, err := dc.getVirtualMachines(ctx, vc)
 	if err != nil {
 		klog.Errorf("Get vm list of datacenter %s failed.", dc.Datacenter.Name)
 		return nil, err
@@ -100,6 +102,83 @@ func (dc *Datacenter) GetVirtualMachineByUUID(ctx context.Context, hostname stri
 	return nil, ErrVMNotFound
 }
 
+// GetAllDatastores returns all datastores in the datacenter.
+func (dc *Datacenter) GetAllDatastores(ctx context.Context) ([]*DatastoreInfo, error) {
+	vc, err := GetVirtualCenterManager().GetVirtualCenter(dc.VirtualCenterHost)
+	if err != nil {
+		klog.Errorf("Failed to get VC for datacenter %v with err: %v", dc, err)
+		return nil, err
+	}
+	if err := vc.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	var dsList []*DatastoreInfo
+	err = vc.withSession(ctx, func(c *client.Client) error {
+		datastoreList, err := icsdc.NewDatacenterService(c).GetDatacenterStorageList(ctx, dc.Datacenter.ID)
+		if err != nil {
+			return err
+		}
+		for _, datastore := range datastoreList {
+			dsList = append(dsList,
+				&DatastoreInfo{
+					ID:            datastore.ID,
+					Type:          datastore.DataStoreType,
+					Name:          datastore.Name,
+					Capacity:      datastore.Capacity,
+					AvailCapacity: datastore.AvailCapacity,
+				})
+		}
+		return nil
+	})
+	if err != nil {
+		klog.Errorf("Get datastore list of datacenter %s failed with err: %v", dc.Datacenter.Name, err)
+		return nil, err
+	}
+	return dsList, nil
+}
+
+// getVirtualMachines returns the virtual machines in the datacenter.
+func (dc *Datacenter) getVirtualMachines(ctx context.Context, vc *VirtualCenter) ([]*types.VirtualMachine, error) {
+	var vmList []*types.VirtualMachine
+	err := vc.withSession(ctx, func(c *client.Client) error {
+		var err error
+		vmList, err = icsdc.NewDatacenterService(c).GetDatacenterVMList(ctx, dc.Datacenter.ID)
+		return err
+	})
+	return vmList, err
+}
+
+// GetVirtualMachinesByVolume returns the virtual machines in the datacenter the volume is attached to.
+func (dc *Datacenter) GetVirtualMachinesByVolume(ctx context.Context, volumeId string) ([]*VirtualMachine, error) {
+	vc, err := GetVirtualCenterManager().GetVirtualCenter(dc.VirtualCenterHost)
+	if err != nil {
+		klog.Errorf("Failed to get VC for datacenter %v with err: %v", dc, err)
+		return nil, err
+	}
+	if err := vc.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	vmList, err := dc.getVirtualMachines(ctx, vc)
+	if err != nil {
+		klog.Errorf("Get vm list of datacenter %s failed.", dc.Datacenter.Name)
+		return nil, err
+	}
+	var vms []*VirtualMachine
+	for _, vmItem := range vmList {
+		if getAttachedDisk(vmItem, volumeId) != nil {
+			vms = append(vms, &VirtualMachine{
+				VirtualCenterHost: dc.VirtualCenterHost,
+				UUID:              vmItem.UUID,
+				VirtualMachine:    vmItem,
+				Datacenter:        dc,
+			})
+		}
+	}
+	return vms, nil
+}
+
 func asyncGetAllDatacenters(ctx context.Context, dcsChan chan<- *Datacenter, errChan chan<- error) {
 	defer close(dcsChan)
 	defer close(errChan)
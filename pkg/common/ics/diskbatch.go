@@ -0,0 +1,345 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ics
+
+import (
+	"context"
+	"fmt"
+	"github.com/inspur-ics/ics-go-sdk/client"
+	"github.com/inspur-ics/ics-go-sdk/client/types"
+	icsvm "github.com/inspur-ics/ics-go-sdk/vm"
+	"k8s.io/klog"
+	"sync"
+	"time"
+)
+
+// diskBatchWindow is how long disk changes of a virtual machine are collected
+// before they are applied in a single reconfiguration.
+const diskBatchWindow = 200 * time.Millisecond
+
+// diskChange is a pending attach or detach of a volume on a virtual machine.
+type diskChange struct {
+	// ctx represents the context of the request waiting for the change.
+	ctx context.Context
+	// volumeId represents the volume to attach or detach.
+	volumeId string
+	// disk represents the disk to add for an attach, nil for a detach.
+	disk *types.Disk
+	// result receives the outcome once the change is applied.
+	result chan diskChangeResult
+}
+
+// operation returns the operation the task applying the change is recorded for.
+func (c *diskChange) operation() string {
+	if c.disk == nil {
+		return taskOperationDetach
+	}
+	return taskOperationAttach
+}
+
+// diskChangeResult is the outcome of a disk change.
+type diskChangeResult struct {
+	// scsiId represents the SCSI id of the attached disk.
+	scsiId string
+	err    error
+}
+
+// diskBatcher collects the disk changes of a virtual machine and applies
+// them in a single reconfiguration.
+type diskBatcher struct {
+	// lock protects pending, scheduled and removed.
+	lock      sync.Mutex
+	pending   []*diskChange
+	scheduled bool
+	// removed tells the batcher is idle and deleted from the batchers of the volume manager,
+	// changes must be submitted to a new batcher.
+	removed bool
+	// flushLock serializes the reconfigurations of the virtual machine.
+	flushLock sync.Mutex
+}
+
+// submitDiskChange queues the disk change of the virtual machine and waits until it is applied
+// or the context is done. A change which was sent to iCenter is not rolled back when the
+// context is done, the retried request finds it in effect.
+func (m *volumeManager) submitDiskChange(ctx context.Context, vm *VirtualMachine, change *diskChange) (string, error) {
+	change.ctx = ctx
+	change.result = make(chan diskChangeResult, 1)
+
+	for {
+		value, _ := m.diskBatchers.LoadOrStore(vm.UUID, &diskBatcher{})
+		batcher := value.(*diskBatcher)
+		batcher.lock.Lock()
+		if batcher.removed {
+			batcher.lock.Unlock()
+			continue
+		}
+		batcher.pending = append(batcher.pending, change)
+		if !batcher.scheduled {
+			batcher.scheduled = true
+			go m.flushDiskChanges(vm, batcher)
+		}
+		batcher.lock.Unlock()
+		break
+	}
+
+	select {
+	case result := <-change.result:
+		return result.scsiId, result.err
+	case <-ctx.Done():
+		klog.Errorf("Waiting for disk change of volume %s on VM %v aborted with err: %v", change.volumeId, vm, ctx.Err())
+		return "", ctx.Err()
+	}
+}
+
+// flushDiskChanges applies the disk changes collected during the batch window. If the batch
+// fails, its changes are applied one by one, so that a bad change does not fail the others.
+// The batcher is deleted once it is idle.
+func (m *volumeManager) flushDiskChanges(vm *VirtualMachine, batcher *diskBatcher) {
+	time.Sleep(diskBatchWindow)
+	batcher.flushLock.Lock()
+	defer batcher.flushLock.Unlock()
+
+	batcher.lock.Lock()
+	changes := batcher.pending
+	batcher.pending = nil
+	batcher.scheduled = false
+	batcher.lock.Unlock()
+
+	ctx, cancel := m.getDiskChangesContext(changes)
+	defer cancel()
+	err := m.applyDiskChanges(ctx, vm, changes)
+	if err != nil && len(changes) > 1 && ctx.Err() == nil {
+		klog.Warningf("Reconfigure disks of VM %v for %d volumes failed, applying the changes one by one", vm, len(changes))
+		for _, change := range changes {
+			change.result <- m.applyDiskChange(ctx, vm, change)
+		}
+	} else {
+		for _, change := range changes {
+			result := diskChangeResult{err: err}
+			if err == nil {
+				result = getDiskChangeResult(vm, change)
+			}
+			change.result <- result
+		}
+	}
+
+	batcher.lock.Lock()
+	if !batcher.scheduled && len(batcher.pending) == 0 {
+		batcher.removed = true
+		m.diskBatchers.Delete(vm.UUID)
+	}
+	batcher.lock.Unlock()
+}
+
+// applyDiskChange applies a single disk change of a failed batch. The change is skipped
+// if its request is done, the retried request applies it again.
+func (m *volumeManager) applyDiskChange(ctx context.Context, vm *VirtualMachine, change *diskChange) diskChangeResult {
+	if err := change.ctx.Err(); err != nil {
+		return diskChangeResult{err: err}
+	}
+	err := m.applyDiskChanges(ctx, vm, []*diskChange{change})
+	if err != nil {
+		return diskChangeResult{err: err}
+	}
+	return getDiskChangeResult(vm, change)
+}
+
+// getDiskChangesContext returns the context a batch of disk changes is applied with.
+// It has the latest deadline of the changes, so that a request with a short deadline
+// does not abort the changes of the others. The deadline of each change is bounded by
+// the attach or detach timeout, the batch has no deadline only if a change has none.
+func (m *volumeManager) getDiskChangesContext(changes []*diskChange) (context.Context, context.CancelFunc) {
+	now := time.Now()
+	var latest time.Time
+	for _, change := range changes {
+		deadline, ok := change.ctx.Deadline()
+		timeout := m.attachTimeout
+		if change.disk == nil {
+			timeout = m.detachTimeout
+		}
+		if limit := now.Add(timeout); timeout > 0 && (!ok || limit.Before(deadline)) {
+			deadline, ok = limit, true
+		}
+		if !ok {
+			return context.WithCancel(context.Background())
+		}
+		if deadline.After(latest) {
+			latest = deadline
+		}
+	}
+	return context.WithDeadline(context.Background(), latest)
+}
+
+// applyDiskChanges reconfigures the latest disks of the virtual machine with the changes.
+// Changes which are already in effect are skipped.
+func (m *volumeManager) applyDiskChanges(ctx context.Context, vm *VirtualMachine, changes []*diskChange) error {
+	err := m.virtualCenter.Connect(ctx)
+	if err != nil {
+		klog.Errorf("Virtual Center Connect failed with err: %+v", err)
+		return err
+	}
+	err = m.resumeDiskTasks(ctx, changes)
+	if err != nil {
+		return err
+	}
+	err = vm.renew(ctx, m.virtualCenter)
+	if err != nil {
+		klog.Errorf("Get VM %v info failed with err: %+v", vm, err)
+		return err
+	}
+
+	disks, pending := mergeDiskChanges(vm.VirtualMachine.Disks, changes)
+	if len(pending) == 0 {
+		klog.V(4).Infof("Disks of VM %v are up to date, nothing to reconfigure", vm)
+		return nil
+	}
+	var volumeIds []string
+	for _, change := range pending {
+		volumeIds = append(volumeIds, change.volumeId)
+	}
+
+	reconfiguration, err := newDiskReconfiguration(vm.VirtualMachine, disks)
+	if err != nil {
+		klog.Errorf("Failed to reconfigure disks of VM %v for volumes %v with err: %+v", vm, volumeIds, err)
+		return err
+	}
+	klog.V(4).Infof("Reconfiguring disks of VM %v for volumes %v", vm, volumeIds)
+	var task *types.Task
+	err = m.virtualCenter.withSession(ctx, func(c *client.Client) error {
+		var err error
+		task, err = icsvm.NewVirtualMachineService(c).SetVM(ctx, reconfiguration)
+		return err
+	})
+	if err != nil {
+		klog.Errorf("Failed to reconfigure disks of VM %v for volumes %v with err: %+v", vm, volumeIds, err)
+		return err
+	}
+
+	klog.V(5).Infof("Reconfigure disks of VM %v task info: %+v", vm, *task)
+	var saveErr error
+	for _, change := range pending {
+		err = m.tasks.put(change.operation(), change.volumeId, taskRecord{TaskID: task.TaskId})
+		if err != nil && saveErr == nil {
+			saveErr = err
+		}
+	}
+	taskState, err := GetTaskState(ctx, m.virtualCenter, task)
+	if err == nil || ctx.Err() == nil {
+		for _, change := range pending {
+			m.tasks.remove(change.operation(), change.volumeId)
+		}
+	}
+	err = getUnsavedTaskError(ctx, err, saveErr)
+	if err != nil {
+		klog.Errorf("Reconfigure disks of VM %v task failed with err: %+v", vm, err)
+		return err
+	} else if taskState != "FINISHED" {
+		errMsg := fmt.Sprintf("Reconfigure disks of VM %v for volumes %v task state %s", vm, volumeIds, taskState)
+		klog.Errorf(errMsg)
+		return newDriverError(errMsg)
+	}
+
+	err = vm.renew(ctx, m.virtualCenter)
+	if err != nil {
+		klog.Errorf("Get VM %v info failed with err: %+v", vm, err)
+		return err
+	}
+	// Disks which were not changed must have survived the reconfiguration
+	for _, disk := range disks {
+		diskId := disk.ID
+		if disk.Volume != nil {
+			diskId = disk.Volume.ID
+		}
+		if getAttachedDisk(vm.VirtualMachine, diskId) == nil {
+			errMsg := fmt.Sprintf("Disk %s of VM %v lost while reconfiguring volumes %v.", diskId, vm, volumeIds)
+			klog.Errorf(errMsg)
+			return newDriverError(errMsg)
+		}
+	}
+	klog.V(5).Infof("Reconfigure disks of VM %v for volumes %v task finished", vm, volumeIds)
+	return nil
+}
+
+// resumeDiskTasks waits for the recorded tasks of the changes, started before the
+// controller restarted, so that the disks are reconfigured after those tasks complete.
+func (m *volumeManager) resumeDiskTasks(ctx context.Context, changes []*diskChange) error {
+	resumed := make(map[string]bool)
+	for _, change := range changes {
+		record, found := m.tasks.get(change.operation(), change.volumeId)
+		if !found {
+			continue
+		}
+		if !resumed[record.TaskID] {
+			klog.V(2).Infof("Resuming %s task %s of volume %s", change.operation(), record.TaskID, change.volumeId)
+			taskState, err := GetTaskState(ctx, m.virtualCenter, &types.Task{TaskId: record.TaskID})
+			if err != nil && ctx.Err() != nil {
+				return err
+			}
+			klog.V(4).Infof("Resumed task %s completed with state %s and err: %v", record.TaskID, taskState, err)
+			resumed[record.TaskID] = true
+		}
+		m.tasks.remove(change.operation(), change.volumeId)
+	}
+	return nil
+}
+
+// mergeDiskChanges returns the disks with the changes applied, along with the changes
+// which are not in effect yet. The current disks are left unchanged.
+func mergeDiskChanges(current []types.Disk, changes []*diskChange) ([]types.Disk, []*diskChange) {
+	disks := make([]types.Disk, 0, len(current)+len(changes))
+	disks = append(disks, current...)
+	var pending []*diskChange
+	for _, change := range changes {
+		attached := false
+		for i := range disks {
+			if isVolumeDisk(&disks[i], change.volumeId) {
+				attached = true
+				if change.disk == nil {
+					disks = append(disks[:i], disks[i+1:]...)
+					pending = append(pending, change)
+				}
+				break
+			}
+		}
+		if !attached && change.disk != nil {
+			disks = append(disks, *change.disk)
+			pending = append(pending, change)
+		}
+	}
+	return disks, pending
+}
+
+// getDiskChangeResult checks the disk change is in effect on the virtual machine.
+func getDiskChangeResult(vm *VirtualMachine, change *diskChange) diskChangeResult {
+	disk := getAttachedDisk(vm.VirtualMachine, change.volumeId)
+	if change.disk != nil {
+		if disk == nil || disk.Volume == nil || disk.Volume.ScsiID == "" {
+			errMsg := fmt.Sprintf("Attach volume %s task failed, volume not found on VM %v.", change.volumeId, vm)
+			klog.Errorf(errMsg)
+			return diskChangeResult{err: newDriverError(errMsg)}
+		}
+		klog.V(5).Infof("Volume %s attached to VM %v, disk label %s", change.volumeId, vm, disk.Label)
+		return diskChangeResult{scsiId: disk.Volume.ScsiID}
+	}
+	if disk != nil {
+		errMsg := fmt.Sprintf("Detach volume %s task failed, volume still found on VM %v.", change.volumeId, vm)
+		klog.Errorf(errMsg)
+		return diskChangeResult{err: newDriverError(errMsg)}
+	}
+	klog.V(5).Infof("Volume %s detached from VM %v", change.volumeId, vm)
+	return diskChangeResult{}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ics
+
+import (
+	"context"
+	"github.com/inspur-ics/ics-go-sdk/client/types"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func getDiskIDs(disks []types.Disk) []string {
+	ids := []string{}
+	for _, disk := range disks {
+		ids = append(ids, disk.ID)
+	}
+	return ids
+}
+
+func TestMergeDiskChanges(t *testing.T) {
+	attach := &diskChange{volumeId: "volume-1", disk: &types.Disk{ID: "volume-1"}}
+	detach := &diskChange{volumeId: "volume-1"}
+	detachOther := &diskChange{volumeId: "volume-2"}
+	tests := []struct {
+		name          string
+		current       []string
+		changes       []*diskChange
+		expectedDisks []string
+		expectedCount int
+	}{
+		{"attach", []string{"disk-1"}, []*diskChange{attach}, []string{"disk-1", "volume-1"}, 1},
+		{"attach attached", []string{"disk-1", "volume-1"}, []*diskChange{attach}, []string{"disk-1", "volume-1"}, 0},
+		{"detach", []string{"disk-1", "volume-1"}, []*diskChange{detach}, []string{"disk-1"}, 1},
+		{"detach detached", []string{"disk-1"}, []*diskChange{detach}, []string{"disk-1"}, 0},
+		{"attach and detach", []string{"disk-1", "volume-2"}, []*diskChange{attach, detachOther},
+			[]string{"disk-1", "volume-1"}, 2},
+	}
+	for _, test := range tests {
+		var current []types.Disk
+		for _, id := range test.current {
+			current = append(current, types.Disk{ID: id})
+		}
+		disks, pending := mergeDiskChanges(current, test.changes)
+		if ids := getDiskIDs(disks); !reflect.DeepEqual(ids, test.expectedDisks) {
+			t.Errorf("%s: disks = %v, want %v", test.name, ids, test.expectedDisks)
+		}
+		if len(pending) != test.expectedCount {
+			t.Errorf("%s: %d pending changes, want %d", test.name, len(pending), test.expectedCount)
+		}
+		if ids := getDiskIDs(current); !reflect.DeepEqual(ids, test.current) {
+			t.Errorf("%s: current disks modified to %v", test.name, ids)
+		}
+	}
+}
+
+func TestGetDiskChangeResult(t *testing.T) {
+	vm := &VirtualMachine{VirtualMachine: newTestVM()}
+	tests := []struct {
+		name   string
+		change *diskChange
+		valid  bool
+	}{
+		{"detached", &diskChange{volumeId: "volume-1"}, true},
+		{"still attached", &diskChange{volumeId: "disk-1"}, false},
+		{"not attached", &diskChange{volumeId: "volume-1", disk: &types.Disk{ID: "volume-1"}}, false},
+	}
+	for _, test := range tests {
+		result := getDiskChangeResult(vm, test.change)
+		if (result.err == nil) != test.valid {
+			t.Errorf("%s: getDiskChangeResult returned err: %v", test.name, result.err)
+		}
+		if result.err != nil && GetErrorKind(result.err) != ErrorKindUnknown {
+			t.Errorf("%s: getDiskChangeResult err %v is of kind %v", test.name, result.err, GetErrorKind(result.err))
+		}
+	}
+}
+
+func TestGetDiskChangesContext(t *testing.T) {
+	m := &volumeManager{attachTimeout: time.Minute, detachTimeout: 2 * time.Minute}
+	background := context.Background()
+	short, cancelShort := context.WithTimeout(background, 10*time.Second)
+	defer cancelShort()
+	long, cancelLong := context.WithTimeout(background, time.Hour)
+	defer cancelLong()
+	attach := func(ctx context.Context) *diskChange {
+		return &diskChange{ctx: ctx, volumeId: "volume-1", disk: &types.Disk{ID: "volume-1"}}
+	}
+	detach := func(ctx context.Context) *diskChange {
+		return &diskChange{ctx: ctx, volumeId: "volume-2"}
+	}
+	tests := []struct {
+		name     string
+		manager  *volumeManager
+		changes  []*diskChange
+		expected time.Duration
+	}{
+		{"attach timeout", m, []*diskChange{attach(background)}, time.Minute},
+		{"detach timeout", m, []*diskChange{detach(background)}, 2 * time.Minute},
+		{"request deadline", m, []*diskChange{attach(short)}, 10 * time.Second},
+		{"timeout before request deadline", m, []*diskChange{attach(long)}, time.Minute},
+		{"latest deadline", m, []*diskChange{attach(short), detach(background)}, 2 * time.Minute},
+		{"request deadline without timeout", &volumeManager{}, []*diskChange{attach(short)}, 10 * time.Second},
+		{"no deadline", &volumeManager{}, []*diskChange{attach(short), detach(background)}, 0},
+	}
+	for _, test := range tests {
+		ctx, cancel := test.manager.getDiskChangesContext(test.changes)
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if test.expected == 0 {
+			if ok {
+				t.Errorf("%s: deadline %v, want none", test.name, deadline)
+			}
+			continue
+		}
+		if remaining := time.Until(deadline); !ok || remaining > test.expected || remaining < test.expected-time.Second {
+			t.Errorf("%s: deadline in %v, want %v", test.name, remaining, test.expected)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ics
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorKind classifies the failures of iCenter operations.
+type ErrorKind int
+
+const (
+	// ErrorKindUnknown is a failure which could not be classified.
+	ErrorKindUnknown ErrorKind = iota
+	// ErrorKindNotFound is a failure on a volume, snapshot or virtual machine which does not exist.
+	ErrorKindNotFound
+	// ErrorKindInUse is a failure on a volume which is attached to another virtual machine.
+	ErrorKindInUse
+	// ErrorKindExhausted is a failure for lack of resources like free disk slots or space.
+	ErrorKindExhausted
+	// ErrorKindUnauthenticated is a failure for a session the virtual center no longer accepts.
+	ErrorKindUnauthenticated
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorKindNotFound:
+		return "NotFound"
+	case ErrorKindInUse:
+		return "InUse"
+	case ErrorKindExhausted:
+		return "Exhausted"
+	case ErrorKindUnauthenticated:
+		return "Unauthenticated"
+	default:
+		return "Unknown"
+	}
+}
+
+// errorKindKeywords are the phrases iCenter uses in the messages of failed
+// requests and tasks, used to classify the errors returned by the SDK. They are
+// full phrases, as single words like "exceeded" also appear in transient
+// failures such as timeouts. Only an expired or invalid session is unauthenticated,
+// "unauthorized" is also returned for calls the user has no permission for.
+var errorKindKeywords = []struct {
+	kind     ErrorKind
+	keywords []string
+}{
+	{ErrorKindNotFound, []string{"not found", "not exist", "no such"}},
+	{ErrorKindInUse, []string{"in use", "already attached", "already mounted", "occupied"}},
+	{ErrorKindExhausted, []string{"no free space", "no free slot", "insufficient space", "insufficient storage",
+		"not enough space", "not enough storage", "maximum number of disks", "disk number exceeds"}},
+	{ErrorKindUnauthenticated, []string{"not login", "not logged in", "token expired", "token is expired",
+		"invalid token", "session expired"}},
+}
+
+// Error is a failure of an iCenter operation along with its kind.
+type Error struct {
+	// Kind represents the class of the failure.
+	Kind ErrorKind
+	// Err represents the underlying error.
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// NewError returns an error of the given kind with the formatted message.
+func NewError(kind ErrorKind, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// newDriverError returns an error for a failure the driver detected itself. It
+// is created with a kind, so that its message is not classified as if iCenter
+// had returned it.
+func newDriverError(msg string) error {
+	return &Error{Kind: ErrorKindUnknown, Err: errors.New(msg)}
+}
+
+// GetErrorKind returns the kind of the error. Errors which were not created
+// with a kind, which are those returned by the SDK, are classified by their
+// message.
+func GetErrorKind(err error) ErrorKind {
+	if err == nil {
+		return ErrorKindUnknown
+	}
+	var icsErr *Error
+	if errors.As(err, &icsErr) {
+		return icsErr.Kind
+	}
+	if errors.Is(err, ErrVMNotFound) {
+		return ErrorKindNotFound
+	}
+	msg := strings.ToLower(err.Error())
+	for _, entry := range errorKindKeywords {
+		for _, keyword := range entry.keywords {
+			if strings.Contains(msg, keyword) {
+				return entry.kind
+			}
+		}
+	}
+	return ErrorKindUnknown
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ics
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestGetErrorKind(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected ErrorKind
+	}{
+		{nil, ErrorKindUnknown},
+		{NewError(ErrorKindNotFound, "Volume %s not found", "volume-1"), ErrorKindNotFound},
+		{fmt.Errorf("Attach failed: %w", NewError(ErrorKindInUse, "Volume is attached")), ErrorKindInUse},
+		{fmt.Errorf("Lookup failed: %w", ErrVMNotFound), ErrorKindNotFound},
+		{errors.New("Volume does not exist"), ErrorKindNotFound},
+		{errors.New("Volume is in use by another VM"), ErrorKindInUse},
+		{errors.New("No free slot for the disk"), ErrorKindExhausted},
+		{errors.New("Session expired, please log in"), ErrorKindUnauthenticated},
+		{errors.New("Unauthorized: no permission to delete the volume"), ErrorKindUnknown},
+		{errors.New("Request timeout exceeded"), ErrorKindUnknown},
+		// Failures detected by the driver are not classified by their message
+		{newDriverError("Volume volume-1 not found on VM node-1"), ErrorKindUnknown},
+	}
+	for _, test := range tests {
+		if kind := GetErrorKind(test.err); kind != test.expected {
+			t.Errorf("GetErrorKind(%v) = %v, want %v", test.err, kind, test.expected)
+		}
+	}
+}
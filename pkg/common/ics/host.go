@@ -19,6 +19,7 @@ package ics
 import (
 	"context"
 	"fmt"
+	"github.com/inspur-ics/ics-go-sdk/client"
 	"github.com/inspur-ics/ics-go-sdk/client/types"
 	icshost "github.com/inspur-ics/ics-go-sdk/host"
 	"k8s.io/klog"
@@ -65,22 +66,27 @@ func (host *Host) GetAllAccessibleDatastores(ctx context.Context) ([]*DatastoreI
 		return nil, err
 	}
 
-	hostService := icshost.NewHostService(vc.Client)
-	datastoreList, err := hostService.GetHostAvailStorages(ctx, host.Host.ID)
+	var dsList []*DatastoreInfo
+	err = vc.withSession(ctx, func(c *client.Client) error {
+		datastoreList, err := icshost.NewHostService(c).GetHostAvailStorages(ctx, host.Host.ID)
+		if err != nil {
+			return err
+		}
+		for _, datastore := range datastoreList {
+			dsList = append(dsList,
+				&DatastoreInfo{
+					ID:            datastore.ID,
+					Type:          datastore.DataStoreType,
+					Name:          datastore.Name,
+					Capacity:      datastore.Capacity,
+					AvailCapacity: datastore.AvailCapacity,
+				})
+		}
+		return nil
+	})
 	if err != nil {
 		klog.Errorf("Failed to get datastore list for host %s with err: %v", host.Host.Name, err)
 		return nil, err
 	}
-	var dsList []*DatastoreInfo
-	for _, datastore := range datastoreList {
-		dsList = append(dsList,
-			&DatastoreInfo{
-				ID:            datastore.ID,
-				Type:          datastore.DataStoreType,
-				Name:          datastore.Name,
-				Capacity:      datastore.Capacity,
-				AvailCapacity: datastore.AvailCapacity,
-			})
-	}
 	return dsList, nil
 }
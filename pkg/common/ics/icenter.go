@@ -18,24 +18,37 @@ package ics
 
 import (
 	"context"
+	"expvar"
 	"fmt"
 	icsgo "github.com/inspur-ics/ics-go-sdk"
 	"github.com/inspur-ics/ics-go-sdk/client"
+	"github.com/inspur-ics/ics-go-sdk/client/types"
 	icsdc "github.com/inspur-ics/ics-go-sdk/datacenter"
 	"k8s.io/klog"
 	"strconv"
 	"sync"
 )
 
+var (
+	// sessionLogins counts the logins to each virtual center host.
+	sessionLogins = expvar.NewMap("ics_session_logins")
+	// sessionReuses counts the calls reusing the session of each virtual center host.
+	sessionReuses = expvar.NewMap("ics_session_reuses")
+)
+
 // VirtualCenter holds details of a virtual center instance.
 type VirtualCenter struct {
 	// Config represents the virtual center configuration.
 	Config *VirtualCenterConfig
-	// Client represents the govmomi client instance for the connection.
+	// Client represents the govmomi client instance for the connection. It is
+	// replaced when the client logs in again, use withSession to call with it.
 	Client *client.Client
 	// CnsClient represents the CNS client instance.
 	//CnsClient       *cns.Client
+	// credentialsLock guards Client, its session and loggingIn.
 	credentialsLock sync.Mutex
+	// loggingIn is closed when the login in progress, if any, completes.
+	loggingIn chan struct{}
 }
 
 // VirtualCenterConfig represents virtual center configuration.
@@ -65,8 +78,86 @@ func (vcc *VirtualCenterConfig) String() string {
 		vcc.Password, vcc.Insecure, vcc.RoundTripperCount, vcc.DatacenterPaths)
 }
 
-// connect creates a connection to the virtual center host.
+// Connect makes sure the virtual center client has a session. The session is
+// reused until the virtual center rejects it, see withSession.
 func (vc *VirtualCenter) Connect(ctx context.Context) error {
+	_, _, err := vc.connect(ctx)
+	return err
+}
+
+// connect returns the client of the current session, logging in if there is none, and
+// tells if the session is reused. The lock is not held while logging in, connections
+// made meanwhile wait for that login instead.
+func (vc *VirtualCenter) connect(ctx context.Context) (*client.Client, bool, error) {
+	vc.credentialsLock.Lock()
+	for vc.Client == nil && vc.loggingIn != nil {
+		loggingIn := vc.loggingIn
+		vc.credentialsLock.Unlock()
+		select {
+		case <-loggingIn:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		vc.credentialsLock.Lock()
+	}
+	if c := vc.Client; c != nil {
+		vc.credentialsLock.Unlock()
+		return c, true, nil
+	}
+	loggingIn := make(chan struct{})
+	vc.loggingIn = loggingIn
+	vc.credentialsLock.Unlock()
+
+	c, err := vc.login(ctx)
+
+	vc.credentialsLock.Lock()
+	defer vc.credentialsLock.Unlock()
+	vc.loggingIn = nil
+	close(loggingIn)
+	if err != nil {
+		return nil, false, err
+	}
+	vc.Client = c
+	return c, false, nil
+}
+
+// withSession runs the call with the client of the current session. If the virtual
+// center rejects the session, which expires when it is idle, the client logs in again
+// and the call is run once more. A rejected call has not been carried out, so calls
+// starting tasks are retried too.
+func (vc *VirtualCenter) withSession(ctx context.Context, call func(c *client.Client) error) error {
+	c, reused, err := vc.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if reused {
+		sessionReuses.Add(vc.Config.Host, 1)
+	}
+	err = call(c)
+	if GetErrorKind(err) != ErrorKindUnauthenticated {
+		return err
+	}
+	klog.V(2).Infof("Session of virtual center %s rejected with err: %v, logging in again", vc.Config.Host, err)
+	vc.invalidateSession(c)
+	c, _, err = vc.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return call(c)
+}
+
+// invalidateSession drops the rejected session of the client, so that the next connection
+// logs in again. The session is kept if another call replaced the client meanwhile.
+func (vc *VirtualCenter) invalidateSession(c *client.Client) {
+	vc.credentialsLock.Lock()
+	defer vc.credentialsLock.Unlock()
+	if vc.Client == c {
+		vc.Client = nil
+	}
+}
+
+// login creates a new authenticated client for the virtual center host.
+func (vc *VirtualCenter) login(ctx context.Context) (*client.Client, error) {
 	conn := &icsgo.ICSConnection{
 		Username: vc.Config.Username,
 		Password: vc.Config.Password,
@@ -78,11 +169,11 @@ func (vc *VirtualCenter) Connect(ctx context.Context) error {
 	client, err := conn.GetClient()
 	if err != nil {
 		klog.Errorf("virtual center connect failed: vc %s\n", vc.Config.Host)
-		return err
+		return nil, err
 	}
-	vc.Client = client
+	sessionLogins.Add(vc.Config.Host, 1)
 	klog.V(4).Infof("virtual center connect successfully: vc %s\n", vc.Config.Host)
-	return nil
+	return client, nil
 }
 
 // GetDatacenters returns Datacenters found on the VirtualCenter. If no
@@ -92,8 +183,12 @@ func (vc *VirtualCenter) Connect(ctx context.Context) error {
 // Datacenters are returned.
 func (vc *VirtualCenter) GetDatacenters(ctx context.Context) ([]*Datacenter, error) {
 	var dcs []*Datacenter
-	dcService := icsdc.NewDatacenterService(vc.Client)
-	dcList, err := dcService.GetAllDatacenters(ctx)
+	var dcList []*types.Datacenter
+	err := vc.withSession(ctx, func(c *client.Client) error {
+		var err error
+		dcList, err = icsdc.NewDatacenterService(c).GetAllDatacenters(ctx)
+		return err
+	})
 	if err != nil {
 		klog.Errorf("get datacenter list faild for vc: %s\n", vc.Config.Host)
 	} else {
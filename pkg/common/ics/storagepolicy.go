@@ -0,0 +1,92 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/inspur-ics/ics-go-sdk/client"
+	icspolicy "github.com/inspur-ics/ics-go-sdk/storagepolicy"
+	"k8s.io/klog"
+)
+
+// ErrStoragePolicyNotFound is returned when the storage policy is not found.
+var ErrStoragePolicyNotFound = errors.New("Storage policy not found")
+
+// StoragePolicy holds details of an iCenter storage policy.
+type StoragePolicy struct {
+	// ID represents the storage policy id.
+	ID string
+	// Name represents the storage policy name.
+	Name string
+	// DatastoreIDs represents the ids of the datastores compatible with the policy.
+	DatastoreIDs []string
+}
+
+func (p *StoragePolicy) String() string {
+	return fmt.Sprintf("[ID: %v, Name: %v, DatastoreIDs: %v]", p.ID, p.Name, p.DatastoreIDs)
+}
+
+// IsCompatible tells if the datastore is compatible with the storage policy.
+func (p *StoragePolicy) IsCompatible(datastoreID string) bool {
+	for _, id := range p.DatastoreIDs {
+		if id == datastoreID {
+			return true
+		}
+	}
+	return false
+}
+
+// GetStoragePolicy returns the storage policy with the given id or name
+// along with the datastores compatible with it.
+func (vc *VirtualCenter) GetStoragePolicy(ctx context.Context, policyIDOrName string) (*StoragePolicy, error) {
+	if err := vc.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	var policy *StoragePolicy
+	err := vc.withSession(ctx, func(c *client.Client) error {
+		policyService := icspolicy.NewStoragePolicyService(c)
+		policyList, err := policyService.GetAllStoragePolicies(ctx)
+		if err != nil {
+			klog.Errorf("Failed to get storage policies of vc %s with err: %v", vc.Config.Host, err)
+			return err
+		}
+		for _, policyItem := range policyList {
+			if policyItem.ID != policyIDOrName && policyItem.Name != policyIDOrName {
+				continue
+			}
+			storageList, err := policyService.GetCompatibleStorages(ctx, policyItem.ID)
+			if err != nil {
+				klog.Errorf("Failed to get compatible datastores of storage policy %s with err: %v", policyItem.Name, err)
+				return err
+			}
+			policy = &StoragePolicy{ID: policyItem.ID, Name: policyItem.Name}
+			for _, storage := range storageList {
+				policy.DatastoreIDs = append(policy.DatastoreIDs, storage.ID)
+			}
+			return nil
+		}
+		return ErrStoragePolicyNotFound
+	})
+	if err != nil {
+		return nil, err
+	}
+	klog.V(4).Infof("Storage policy %v found for %q", policy, policyIDOrName)
+	return policy, nil
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/inspur-ics/ics-go-sdk/client/types"
+	"k8s.io/klog"
+	"sync"
+)
+
+// Operations the in-flight tasks are recorded for.
+const (
+	taskOperationCreate = "create"
+	taskOperationDelete = "delete"
+	taskOperationExpand = "expand"
+	taskOperationAttach = "attach"
+	taskOperationDetach = "detach"
+)
+
+// TaskStoreBackend saves the records of the in-flight tasks, so that they outlive
+// the controller and the node it runs on.
+type TaskStoreBackend interface {
+	// Load returns the records last saved, or nil if none are saved.
+	Load() ([]byte, error)
+	// Save replaces the saved records.
+	Save(data []byte) error
+}
+
+// taskRecord is an in-flight iCenter task of an operation on a volume.
+type taskRecord struct {
+	// TaskID represents the id of the task in iCenter.
+	TaskID string `json:"taskId"`
+	// DatastoreID represents the datastore a volume is created on.
+	DatastoreID string `json:"datastoreId,omitempty"`
+	// SizeGB represents the size a volume is expanded to.
+	SizeGB float64 `json:"sizeGB,omitempty"`
+}
+
+// taskStore records the in-flight iCenter tasks keyed by operation and volume,
+// so that a retried operation resumes its task instead of starting another one.
+type taskStore struct {
+	lock sync.Mutex
+	// backend saves the records. The records are kept in memory only if it is nil.
+	backend TaskStoreBackend
+	// loaded tells the records saved by a previous run of the controller are loaded.
+	loaded  bool
+	records map[string]taskRecord
+}
+
+// newTaskStore returns a task store saving its records with backend. The records saved
+// by a previous run of the controller are loaded when the store is first used.
+func newTaskStore(backend TaskStoreBackend) *taskStore {
+	return &taskStore{
+		backend: backend,
+		records: make(map[string]taskRecord),
+	}
+}
+
+func getTaskKey(operation string, volume string) string {
+	return operation + "/" + volume
+}
+
+// get returns the recorded task of the operation on the volume.
+func (s *taskStore) get(operation string, volume string) (taskRecord, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.load(); err != nil {
+		klog.Errorf("Failed to load task store with err: %v", err)
+	}
+	record, found := s.records[getTaskKey(operation, volume)]
+	return record, found
+}
+
+// put records the task of the operation on the volume. The record is kept in memory
+// even if it cannot be saved, so that the operation retried before the controller
+// restarts still resumes the task.
+func (s *taskStore) put(operation string, volume string, record taskRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := s.load()
+	s.records[getTaskKey(operation, volume)] = record
+	if err == nil {
+		err = s.save()
+	}
+	if err != nil {
+		klog.Errorf("Failed to save %s task %s of volume %s with err: %v", operation, record.TaskID, volume, err)
+		return err
+	}
+	return nil
+}
+
+// remove deletes the record of the task of the operation on the volume. A record which
+// cannot be deleted from the backend only makes the controller wait for a completed
+// task after a restart, so the failure is not returned.
+func (s *taskStore) remove(operation string, volume string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := s.load()
+	key := getTaskKey(operation, volume)
+	if _, found := s.records[key]; !found {
+		return
+	}
+	delete(s.records, key)
+	if err == nil {
+		err = s.save()
+	}
+	if err != nil {
+		klog.Errorf("Failed to delete %s task of volume %s from task store with err: %v", operation, volume, err)
+	}
+}
+
+// load adds the records saved by a previous run of the controller, unless they are
+// loaded already. The saved records must be loaded before the records are saved, not
+// to overwrite them. The lock must be held.
+func (s *taskStore) load() error {
+	if s.loaded || s.backend == nil {
+		return nil
+	}
+	data, err := s.backend.Load()
+	if err != nil {
+		return err
+	}
+	s.loaded = true
+	if len(data) == 0 {
+		return nil
+	}
+	saved := make(map[string]taskRecord)
+	if err = json.Unmarshal(data, &saved); err != nil {
+		klog.Errorf("Failed to parse task store records, discarding them with err: %v", err)
+		return nil
+	}
+	for key, record := range saved {
+		if _, found := s.records[key]; !found {
+			s.records[key] = record
+		}
+	}
+	klog.V(2).Infof("Loaded %d in-flight tasks from task store", len(saved))
+	return nil
+}
+
+// save saves the records with the backend of the store. The lock must be held.
+func (s *taskStore) save() error {
+	if s.backend == nil {
+		return nil
+	}
+	data, err := json.Marshal(s.records)
+	if err != nil {
+		return err
+	}
+	return s.backend.Save(data)
+}
+
+// waitForTask resumes the recorded task of the operation on the volume, or starts a new
+// task and records it, then waits for the task to complete and returns its state. The
+// record is kept while the task may still be running, so that the retried operation
+// resumes it.
+func (m *volumeManager) waitForTask(ctx context.Context, operation string, volume string, record taskRecord,
+	start func() (*types.Task, error)) (string, error) {
+	if recorded, found := m.tasks.get(operation, volume); found {
+		return m.resumeTask(ctx, operation, volume, recorded.TaskID)
+	}
+	task, err := start()
+	if err != nil {
+		return "", err
+	}
+	record.TaskID = task.TaskId
+	saveErr := m.tasks.put(operation, volume, record)
+	taskState, err := m.completeTask(ctx, operation, volume, task)
+	return taskState, getUnsavedTaskError(ctx, err, saveErr)
+}
+
+// resumeTask waits for the recorded task of the operation on the volume to complete
+// and returns its state.
+func (m *volumeManager) resumeTask(ctx context.Context, operation string, volume string, taskID string) (string, error) {
+	klog.V(2).Infof("Resuming %s task %s of volume %s", operation, taskID, volume)
+	return m.completeTask(ctx, operation, volume, &types.Task{TaskId: taskID})
+}
+
+// completeTask waits for the task of the operation on the volume and removes its record
+// once the task is no longer running.
+func (m *volumeManager) completeTask(ctx context.Context, operation string, volume string, task *types.Task) (string, error) {
+	taskState, err := GetTaskState(ctx, m.virtualCenter, task)
+	if err != nil && ctx.Err() != nil {
+		return taskState, err
+	}
+	m.tasks.remove(operation, volume)
+	return taskState, err
+}
+
+// getUnsavedTaskError returns the error of waiting for a task whose record failed to
+// save. The task is waited for anyway, since failing at once would let the caller retry
+// the operation while the task is still running. Once the task is no longer running its
+// record is not needed, so the save failure is only reported if waiting stopped before.
+func getUnsavedTaskError(ctx context.Context, err error, saveErr error) error {
+	if saveErr == nil || err == nil || ctx.Err() == nil {
+		return err
+	}
+	return fmt.Errorf("%w, and the record of the running task failed to save: %v", err, saveErr)
+}
+
+// waitForCreateTask is waitForTask for the task creating the volume in req. A resumed
+// task created the volume in the datastore it was started on, which req is updated to.
+func (m *volumeManager) waitForCreateTask(ctx context.Context, req *types.VolumeReq,
+	start func() (*types.Task, error)) (string, error) {
+	if recorded, found := m.tasks.get(taskOperationCreate, req.Name); found {
+		req.DataStoreId = recorded.DatastoreID
+	}
+	return m.waitForTask(ctx, taskOperationCreate, req.Name, taskRecord{DatastoreID: req.DataStoreId}, start)
+}
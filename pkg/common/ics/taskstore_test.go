@@ -0,0 +1,136 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testTaskStoreBackend keeps the saved records in memory.
+type testTaskStoreBackend struct {
+	data    []byte
+	saveErr error
+}
+
+func (b *testTaskStoreBackend) Load() ([]byte, error) {
+	return b.data, nil
+}
+
+func (b *testTaskStoreBackend) Save(data []byte) error {
+	if b.saveErr != nil {
+		return b.saveErr
+	}
+	b.data = data
+	return nil
+}
+
+func TestTaskStore(t *testing.T) {
+	backend := &testTaskStoreBackend{}
+	store := newTaskStore(backend)
+	record := taskRecord{TaskID: "task-1", DatastoreID: "datastore-1"}
+	if err := store.put(taskOperationCreate, "pvc-1", record); err != nil {
+		t.Fatalf("put failed with err: %v", err)
+	}
+	if recorded, found := store.get(taskOperationCreate, "pvc-1"); !found || recorded != record {
+		t.Errorf("get = %+v, %v, want %+v", recorded, found, record)
+	}
+	if _, found := store.get(taskOperationDelete, "pvc-1"); found {
+		t.Errorf("get found a task of another operation")
+	}
+
+	// A restarted controller resumes the recorded task
+	resumed := newTaskStore(backend)
+	if recorded, found := resumed.get(taskOperationCreate, "pvc-1"); !found || recorded != record {
+		t.Errorf("get after restart = %+v, %v, want %+v", recorded, found, record)
+	}
+
+	resumed.remove(taskOperationCreate, "pvc-1")
+	if _, found := resumed.get(taskOperationCreate, "pvc-1"); found {
+		t.Errorf("get found a removed task")
+	}
+	if _, found := newTaskStore(backend).get(taskOperationCreate, "pvc-1"); found {
+		t.Errorf("get after restart found a removed task")
+	}
+}
+
+func TestTaskStoreKeepsSavedRecords(t *testing.T) {
+	saved, err := json.Marshal(map[string]taskRecord{
+		getTaskKey(taskOperationExpand, "volume-1"): {TaskID: "task-1", SizeGB: 20},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal records with err: %v", err)
+	}
+	backend := &testTaskStoreBackend{data: saved}
+	if err = newTaskStore(backend).put(taskOperationDelete, "volume-2", taskRecord{TaskID: "task-2"}); err != nil {
+		t.Fatalf("put failed with err: %v", err)
+	}
+	records := make(map[string]taskRecord)
+	if err = json.Unmarshal(backend.data, &records); err != nil {
+		t.Fatalf("Failed to unmarshal saved records with err: %v", err)
+	}
+	expected := map[string]taskRecord{
+		getTaskKey(taskOperationExpand, "volume-1"): {TaskID: "task-1", SizeGB: 20},
+		getTaskKey(taskOperationDelete, "volume-2"): {TaskID: "task-2"},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Saved records = %+v, want %+v", records, expected)
+	}
+}
+
+func TestTaskStoreSaveFailure(t *testing.T) {
+	backend := &testTaskStoreBackend{saveErr: errors.New("configmap update failed")}
+	store := newTaskStore(backend)
+	record := taskRecord{TaskID: "task-1"}
+	if err := store.put(taskOperationAttach, "volume-1", record); err == nil {
+		t.Errorf("put succeeded without saving the record")
+	}
+	// The task is still resumed until the controller restarts
+	if recorded, found := store.get(taskOperationAttach, "volume-1"); !found || recorded != record {
+		t.Errorf("get = %+v, %v, want %+v", recorded, found, record)
+	}
+}
+
+func TestGetUnsavedTaskError(t *testing.T) {
+	saveErr := errors.New("configmap update failed")
+	taskErr := errors.New("task failed")
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		err      error
+		saveErr  error
+		expected error
+	}{
+		{"saved", done, context.Canceled, nil, context.Canceled},
+		{"task completed", context.Background(), nil, saveErr, nil},
+		{"task failed", context.Background(), taskErr, saveErr, taskErr},
+	}
+	for _, test := range tests {
+		if err := getUnsavedTaskError(test.ctx, test.err, test.saveErr); err != test.expected {
+			t.Errorf("%s: getUnsavedTaskError = %v, want %v", test.name, err, test.expected)
+		}
+	}
+	err := getUnsavedTaskError(done, context.Canceled, saveErr)
+	if !errors.Is(err, context.Canceled) || err == context.Canceled {
+		t.Errorf("getUnsavedTaskError of a running task = %v, want the save failure added", err)
+	}
+}
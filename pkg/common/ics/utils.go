@@ -20,6 +20,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/inspur-ics/ics-go-sdk/client"
 	"github.com/inspur-ics/ics-go-sdk/client/types"
 	icsgo "github.com/inspur-ics/ics-go-sdk/common"
 	icstag "github.com/inspur-ics/ics-go-sdk/tag"
@@ -76,42 +77,66 @@ func GetVcenterIPs(cfg *config.Config) ([]string, error) {
 }
 
 func GetAttachedTags(ctx context.Context, vc *VirtualCenter, targetType string, targetId string) ([]types.Tag, error) {
-	tagService := icstag.NewTagsService(vc.Client)
-	tagList, err := tagService.ListAttachedTags(ctx, targetType, targetId)
-	if err != nil {
-		klog.Errorf("Get attached tag failed for %s  %s with err: %v", targetType, targetId, err)
-		return nil, err
-	}
-
 	var tags []types.Tag
-	for _, tagId := range tagList {
-		tag, err := tagService.GetTag(ctx, tagId)
+	err := vc.withSession(ctx, func(c *client.Client) error {
+		tagService := icstag.NewTagsService(c)
+		tagList, err := tagService.ListAttachedTags(ctx, targetType, targetId)
 		if err != nil {
-			klog.Errorf("Get tag %s info failed with err: %v", tagId, err)
-			return tags, err
+			klog.Errorf("Get attached tag failed for %s  %s with err: %v", targetType, targetId, err)
+			return err
 		}
-		tags = append(tags, *tag)
-	}
-	return tags, nil
+
+		tags = nil
+		for _, tagId := range tagList {
+			tag, err := tagService.GetTag(ctx, tagId)
+			if err != nil {
+				klog.Errorf("Get tag %s info failed with err: %v", tagId, err)
+				return err
+			}
+			tags = append(tags, *tag)
+		}
+		return nil
+	})
+	return tags, err
 }
 
+// GetTaskState waits for the task to complete and returns its state. It returns
+// the context error once the context is done, the task keeps running in iCenter.
 func GetTaskState(ctx context.Context, vc *VirtualCenter, task *types.Task) (string, error) {
 	state := "Unknown"
 	if task == nil {
-		return state, errors.New("Task value is nil")
+		return state, newDriverError("Task value is nil")
 	} else if task.TaskId == "" {
-		return state, errors.New("TaskId is empty")
+		return state, newDriverError("TaskId is empty")
 	}
 
-	restapi := &icsgo.RestAPI{
-		RestAPITripper: vc.Client,
-	}
-	taskInfo, err := restapi.TraceTaskProcess(task)
-	if err != nil || taskInfo == nil {
-		errMsg := fmt.Sprintf("Failed to get  task %s state with err: %+v", task.TaskId, err)
-		return state, errors.New(errMsg)
-	}
+	// TraceTaskProcess takes no context, it is left to finish in the background
+	// when the context is done first
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err = vc.withSession(ctx, func(c *client.Client) error {
+			restapi := &icsgo.RestAPI{
+				RestAPITripper: c,
+			}
+			taskInfo, traceErr := restapi.TraceTaskProcess(task)
+			if traceErr != nil {
+				return fmt.Errorf("Failed to get task %s state with err: %w", task.TaskId, traceErr)
+			} else if taskInfo == nil {
+				return NewError(ErrorKindUnknown, "Failed to get task %s state, task info is empty", task.TaskId)
+			}
+			klog.V(5).Infof("Task %s state: %+v", task.TaskId, taskInfo)
+			state = taskInfo.State
+			return nil
+		})
+	}()
 
-	klog.V(5).Infof("Task %s state: %+v", task.TaskId, taskInfo)
-	return taskInfo.State, nil
+	select {
+	case <-done:
+		return state, err
+	case <-ctx.Done():
+		klog.Errorf("Stopped waiting for task %s with err: %v", task.TaskId, ctx.Err())
+		return "Unknown", ctx.Err()
+	}
 }
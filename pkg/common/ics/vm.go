@@ -20,6 +20,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/inspur-ics/ics-go-sdk/client"
 	"github.com/inspur-ics/ics-go-sdk/client/types"
 	icshost "github.com/inspur-ics/ics-go-sdk/host"
 	icsvm "github.com/inspur-ics/ics-go-sdk/vm"
@@ -68,17 +69,16 @@ func (vm *VirtualMachine) GetHostSystem(ctx context.Context) (*Host, error) {
 		return nil, err
 	}
 
-	hostService := icshost.NewHostService(vc.Client)
-	hostInfo, err := hostService.GetHost(ctx, vm.VirtualMachine.HostID)
+	host := &Host{VirtualCenterHost: vm.VirtualCenterHost}
+	err = vc.withSession(ctx, func(c *client.Client) error {
+		var err error
+		host.Host, err = icshost.NewHostService(c).GetHost(ctx, vm.VirtualMachine.HostID)
+		return err
+	})
 	if err != nil {
 		klog.Errorf("Failed to get host %s info for vm %v with err: %v", vm.VirtualMachine.HostName, vm, err)
 		return nil, err
 	}
-
-	host := &Host{
-		Host:              hostInfo,
-		VirtualCenterHost: vm.VirtualCenterHost,
-	}
 	return host, nil
 }
 
@@ -95,22 +95,24 @@ func (vm *VirtualMachine) GetAllAccessibleDatastores(ctx context.Context) ([]*Da
 
 // renew renews the virtual machine and datacenter objects given its virtual center.
 func (vm *VirtualMachine) renew(ctx context.Context, vc *VirtualCenter) error {
-	vmService := icsvm.NewVirtualMachineService(vc.Client)
-	vminfo, err := vmService.GetVM(ctx, vm.VirtualMachine.ID)
+	err := vc.withSession(ctx, func(c *client.Client) error {
+		vminfo, err := icsvm.NewVirtualMachineService(c).GetVM(ctx, vm.VirtualMachine.ID)
+		if err != nil {
+			return err
+		}
+		vm.VirtualMachine = vminfo
+		return nil
+	})
 	if err != nil {
 		klog.Errorf("Failed to renew vm %v info with err: %v", vm, err)
 		return err
 	}
-	vm.VirtualMachine = vminfo
-	return vm.Datacenter.Renew(false)
+	return vm.Datacenter.Renew(ctx, false)
 }
 
 // Renew renews the virtual machine and datacenter information. If reconnect is
 // set to true, the virtual center connection is also renewed.
-func (vm *VirtualMachine) Renew(reconnect bool) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
+func (vm *VirtualMachine) Renew(ctx context.Context, reconnect bool) error {
 	vc, err := GetVirtualCenterManager().GetVirtualCenter(vm.VirtualCenterHost)
 	if err != nil {
 		klog.Errorf("Failed to get VC while renewing VM %v with err: %v", vm, err)
@@ -20,25 +20,109 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/inspur-ics/ics-go-sdk/client"
 	"github.com/inspur-ics/ics-go-sdk/client/types"
-	icsvm "github.com/inspur-ics/ics-go-sdk/vm"
 	icsvol "github.com/inspur-ics/ics-go-sdk/volume"
 	"k8s.io/klog"
+	"strings"
 	"sync"
+	"time"
 )
 
 // VolumeManager provides functionality to manage volumes.
 type VolumeManager interface {
-	// CreateVolume creates a new volume given its spec.
-	CreateVolume(req types.VolumeReq) (string, error)
+	// CreateVolume creates a new volume given its spec. The volume is created in the
+	// datastore of a resumed task, which may differ from the datastore of the spec.
+	CreateVolume(ctx context.Context, req types.VolumeReq) (*Volume, error)
+	// CreateVolumeFromSnapshot creates a new volume given its spec from a snapshot of the source volume.
+	CreateVolumeFromSnapshot(ctx context.Context, req types.VolumeReq, volumeId string, snapshotId string) (*Volume, error)
+	// CloneVolume creates a new volume given its spec as a full or linked clone of the source volume.
+	CloneVolume(ctx context.Context, req types.VolumeReq, sourceVolumeId string, linkedClone bool) (*Volume, error)
+	// GetVolume returns the volume given its id.
+	GetVolume(ctx context.Context, volumeId string) (*Volume, error)
 	// DeleteVolume deletes a volume given its spec.
-	DeleteVolume(volumeId string, deleteVolume bool) error
+	DeleteVolume(ctx context.Context, volumeId string, deleteVolume bool) error
 	// ExpandVolume expands a volume given its spec.
-	ExpandVolume(volumeId string, capacityInGb float64) error
+	ExpandVolume(ctx context.Context, volumeId string, capacityInGb float64) error
 	// AttachVolume attaches a volume to a virtual machine given the spec.
-	AttachVolume(vm *VirtualMachine, volumeId string) (string, error)
+	AttachVolume(ctx context.Context, vm *VirtualMachine, volumeId string, spec *DiskSpec) (string, error)
 	// DetachVolume detaches a volume from the virtual machine given the spec.
-	DetachVolume(vm *VirtualMachine, volumeId string) error
+	DetachVolume(ctx context.Context, vm *VirtualMachine, volumeId string) error
+	// CreateSnapshot creates a snapshot of the volume with the given name.
+	CreateSnapshot(ctx context.Context, volumeId string, name string) (*VolumeSnapshot, error)
+	// DeleteSnapshot deletes a snapshot of the volume given its id.
+	DeleteSnapshot(ctx context.Context, volumeId string, snapshotId string) error
+	// ListSnapshots returns all snapshots of the volume.
+	ListSnapshots(ctx context.Context, volumeId string) ([]*VolumeSnapshot, error)
+	// GetVolumesInDatastore returns all volumes located in the datastore.
+	GetVolumesInDatastore(ctx context.Context, datastoreId string) ([]*Volume, error)
+}
+
+// Volume holds details of a volume.
+type Volume struct {
+	// ID represents the volume id in iCenter.
+	ID string
+	// Name represents the volume name.
+	Name string
+	// Description represents the volume description.
+	Description string
+	// DatastoreID represents the id of the datastore the volume resides on.
+	DatastoreID string
+	// SizeGB represents the volume size in gibibytes.
+	SizeGB float64
+	// Shared tells if the volume can be attached to multiple virtual machines.
+	Shared bool
+}
+
+func (v Volume) String() string {
+	return fmt.Sprintf("[ID: %v, Name: %v, Description: %v, DatastoreID: %v, SizeGB: %v, Shared: %v]",
+		v.ID, v.Name, v.Description, v.DatastoreID, v.SizeGB, v.Shared)
+}
+
+// VolumeSnapshot holds details of a volume snapshot.
+type VolumeSnapshot struct {
+	// ID represents the snapshot id in iCenter.
+	ID string
+	// Name represents the snapshot name.
+	Name string
+	// VolumeID represents the id of the source volume.
+	VolumeID string
+	// SizeGB represents the size of the source volume when the snapshot was taken.
+	SizeGB float64
+	// CreateTime represents the time the snapshot was taken.
+	CreateTime time.Time
+}
+
+func (s VolumeSnapshot) String() string {
+	return fmt.Sprintf("[ID: %v, Name: %v, VolumeID: %v, SizeGB: %v, CreateTime: %v]",
+		s.ID, s.Name, s.VolumeID, s.SizeGB, s.CreateTime)
+}
+
+// DiskSpec holds the settings of a disk attaching a volume to a virtual machine.
+type DiskSpec struct {
+	// BusModel represents the bus of the disk, "SCSI".
+	BusModel string
+	// CacheMode represents the host cache mode of the disk.
+	CacheMode string
+	// NativeIO tells if the disk uses native asynchronous IO.
+	NativeIO bool
+	// QueueNum represents the number of IO queues of the disk.
+	QueueNum int
+	// MaxIOPS represents the I/O operations per second limit, 0 means unlimited.
+	MaxIOPS int64
+	// MaxBandwidthMBps represents the throughput limit in MiB per second, 0 means unlimited.
+	MaxBandwidthMBps int64
+	// BurstIOPS represents the I/O operations per second allowed for short bursts.
+	BurstIOPS int64
+	// BurstBandwidthMBps represents the throughput in MiB per second allowed for short bursts.
+	BurstBandwidthMBps int64
+}
+
+func (s DiskSpec) String() string {
+	return fmt.Sprintf("[BusModel: %v, CacheMode: %v, NativeIO: %v, QueueNum: %v, "+
+		"MaxIOPS: %v, MaxBandwidthMBps: %v, BurstIOPS: %v, BurstBandwidthMBps: %v]",
+		s.BusModel, s.CacheMode, s.NativeIO, s.QueueNum,
+		s.MaxIOPS, s.MaxBandwidthMBps, s.BurstIOPS, s.BurstBandwidthMBps)
 }
 
 var (
@@ -48,12 +132,26 @@ var (
 	onceForManager sync.Once
 )
 
-// GetManager returns the Manager singleton.
-func GetVolumeManager(vc *VirtualCenter) VolumeManager {
+// VolumeManagerOptions represents the settings of the volume manager.
+type VolumeManagerOptions struct {
+	// TaskStore saves the records of the in-flight tasks.
+	// The tasks are recorded in memory only if it is nil.
+	TaskStore TaskStoreBackend
+	// AttachTimeout and DetachTimeout bound the batches of disk changes which
+	// attach and detach volumes. The batches are not bounded if zero.
+	AttachTimeout time.Duration
+	DetachTimeout time.Duration
+}
+
+// GetManager returns the Manager singleton, set up with the options of the first call.
+func GetVolumeManager(vc *VirtualCenter, options VolumeManagerOptions) VolumeManager {
 	onceForManager.Do(func() {
 		klog.V(1).Infof("Initializing volumeManager...")
 		managerInstance = &volumeManager{
 			virtualCenter: vc,
+			tasks:         newTaskStore(options.TaskStore),
+			attachTimeout: options.AttachTimeout,
+			detachTimeout: options.DetachTimeout,
 		}
 		klog.V(1).Infof("volumeManager initialized")
 	})
@@ -63,6 +161,14 @@ func GetVolumeManager(vc *VirtualCenter) VolumeManager {
 // DefaultManager provides functionality to manage volumes.
 type volumeManager struct {
 	virtualCenter *VirtualCenter
+	// diskBatchers maps virtual machine UUIDs to the *diskBatcher applying
+	// the disk changes of the virtual machine one batch at a time.
+	diskBatchers sync.Map
+	// tasks records the in-flight tasks to resume them when operations are retried.
+	tasks *taskStore
+	// attachTimeout and detachTimeout bound the batches of disk changes.
+	attachTimeout time.Duration
+	detachTimeout time.Duration
 }
 
 func validateManager(m *volumeManager) error {
@@ -75,129 +181,249 @@ func validateManager(m *volumeManager) error {
 }
 
 // CreateVolume creates a new volume given its spec.
-func (m *volumeManager) CreateVolume(req types.VolumeReq) (string, error) {
+func (m *volumeManager) CreateVolume(ctx context.Context, req types.VolumeReq) (*Volume, error) {
 	err := validateManager(m)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	err = m.virtualCenter.Connect(ctx)
+	if err != nil {
+		klog.Errorf("Virtual Center Connect failed with err: %+v", err)
+		return nil, err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 
+	taskState, err := m.waitForCreateTask(ctx, &req, func() (*types.Task, error) {
+		task, err := m.startTask(ctx, func(c *client.Client) (types.Task, error) {
+			return icsvol.NewVolumeService(c).CreateVolume(ctx, req)
+		})
+		if err != nil {
+			klog.Errorf("Create volume %+v failed with err: %+v", req, err)
+			return nil, err
+		}
+		klog.V(5).Infof("Creating volume %+v task info: %+v", req, *task)
+		return task, nil
+	})
+	if err != nil {
+		klog.Errorf("Create volume %+v task failed with err: %+v", req, err)
+		return nil, err
+	} else if taskState != "FINISHED" {
+		errMsg := fmt.Sprintf("Create volume task state %s", taskState)
+		klog.Errorf(errMsg)
+		return nil, newDriverError(errMsg)
+	}
+	klog.V(5).Infof("Create volume %s task finished", req.Name)
+
+	return m.getCreatedVolume(ctx, req)
+}
+
+// CreateVolumeFromSnapshot creates a new volume given its spec from a snapshot of the source volume.
+func (m *volumeManager) CreateVolumeFromSnapshot(ctx context.Context, req types.VolumeReq, volumeId string, snapshotId string) (*Volume, error) {
+	err := validateManager(m)
+	if err != nil {
+		return nil, err
+	}
 	err = m.virtualCenter.Connect(ctx)
 	if err != nil {
 		klog.Errorf("Virtual Center Connect failed with err: %+v", err)
-		return "", err
+		return nil, err
 	}
 
-	volService := icsvol.NewVolumeService(m.virtualCenter.Client)
-	task, err := volService.CreateVolume(ctx, req)
+	taskState, err := m.waitForCreateTask(ctx, &req, func() (*types.Task, error) {
+		task, err := m.startTask(ctx, func(c *client.Client) (types.Task, error) {
+			return icsvol.NewVolumeService(c).CreateVolumeFromSnapshot(ctx, volumeId, snapshotId, req)
+		})
+		if err != nil {
+			klog.Errorf("Create volume %+v from snapshot %s of volume %s failed with err: %+v", req, snapshotId, volumeId, err)
+			return nil, err
+		}
+		klog.V(5).Infof("Creating volume %+v from snapshot %s task info: %+v", req, snapshotId, *task)
+		return task, nil
+	})
 	if err != nil {
-		klog.Errorf("Create volume %+v failed with err: %+v", req, err)
-		return "", err
+		klog.Errorf("Create volume %+v from snapshot %s task failed with err: %+v", req, snapshotId, err)
+		return nil, err
+	} else if taskState != "FINISHED" {
+		errMsg := fmt.Sprintf("Create volume from snapshot %s task state %s", snapshotId, taskState)
+		klog.Errorf(errMsg)
+		return nil, newDriverError(errMsg)
 	}
+	klog.V(5).Infof("Create volume %s from snapshot %s task finished", req.Name, snapshotId)
+
+	return m.getCreatedVolume(ctx, req)
+}
 
-	klog.V(5).Infof("Creating volume %+v task info: %+v", req, task)
-	taskState, err := GetTaskState(ctx, m.virtualCenter, &task)
+// CloneVolume creates a new volume given its spec as a full or linked clone of the source volume.
+func (m *volumeManager) CloneVolume(ctx context.Context, req types.VolumeReq, sourceVolumeId string, linkedClone bool) (*Volume, error) {
+	err := validateManager(m)
 	if err != nil {
-		klog.Errorf("Create volume %+v task failed with err: %+v", req, err)
-		return "", err
+		return nil, err
+	}
+	err = m.virtualCenter.Connect(ctx)
+	if err != nil {
+		klog.Errorf("Virtual Center Connect failed with err: %+v", err)
+		return nil, err
+	}
+
+	taskState, err := m.waitForCreateTask(ctx, &req, func() (*types.Task, error) {
+		task, err := m.startTask(ctx, func(c *client.Client) (types.Task, error) {
+			return icsvol.NewVolumeService(c).CloneVolume(ctx, sourceVolumeId, req, linkedClone)
+		})
+		if err != nil {
+			klog.Errorf("Clone volume %s to %+v failed with err: %+v", sourceVolumeId, req, err)
+			return nil, err
+		}
+		klog.V(5).Infof("Cloning volume %s to %+v (linked: %v) task info: %+v", sourceVolumeId, req, linkedClone, *task)
+		return task, nil
+	})
+	if err != nil {
+		klog.Errorf("Clone volume %s to %+v task failed with err: %+v", sourceVolumeId, req, err)
+		return nil, err
 	} else if taskState != "FINISHED" {
-		errMsg := fmt.Sprintf("Create volume task state %s", taskState)
+		errMsg := fmt.Sprintf("Clone volume %s task state %s", sourceVolumeId, taskState)
 		klog.Errorf(errMsg)
-		return "", errors.New(errMsg)
+		return nil, newDriverError(errMsg)
 	}
-	klog.V(5).Infof("Create volume %s task finished", req.Name)
+	klog.V(5).Infof("Clone volume %s to %s task finished", sourceVolumeId, req.Name)
 
-	volList, err := volService.GetVolumesInDatastore(ctx, req.DataStoreId)
+	return m.getCreatedVolume(ctx, req)
+}
+
+// getCreatedVolumeID looks up the id of the volume created for req in its datastore.
+func (m *volumeManager) getCreatedVolumeID(ctx context.Context, req types.VolumeReq) (*Volume, error) {
+	volumes, err := m.getVolumesInDatastore(ctx, req.DataStoreId)
 	if err != nil {
-		klog.Errorf("Failed to get volume list in storage %s with err: %+v", req.DataStoreId, err)
-		return "", err
+		return nil, err
 	}
-	for _, volInfo := range volList {
-		if volInfo.Name == req.Name {
-			return volInfo.ID, nil
+	for _, volume := range volumes {
+		if volume.Name == req.Name {
+			return volume, nil
 		}
 	}
 
 	errMsg := fmt.Sprintf("Volume %s not found in storage %s. Create volume failed.", req.Name, req.DataStoreId)
 	klog.Errorf(errMsg)
-	return "", errors.New(errMsg)
+	return nil, newDriverError(errMsg)
 }
 
-// DeleteVolume deletes a volume given id.
-func (m *volumeManager) DeleteVolume(volumeId string, deleteVolume bool) error {
+// GetVolume returns the volume given its id.
+func (m *volumeManager) GetVolume(ctx context.Context, volumeId string) (*Volume, error) {
 	err := validateManager(m)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	err = m.virtualCenter.Connect(ctx)
 	if err != nil {
 		klog.Errorf("Virtual Center Connect failed with err: %+v", err)
-		return err
+		return nil, err
 	}
 
-	volService := icsvol.NewVolumeService(m.virtualCenter.Client)
-	task, err := volService.DeleteVolume(ctx, volumeId, deleteVolume)
+	var volume *Volume
+	err = m.virtualCenter.withSession(ctx, func(c *client.Client) error {
+		volInfo, err := icsvol.NewVolumeService(c).GetVolumeInfoById(ctx, volumeId)
+		if err != nil {
+			klog.Errorf("Get volume %s info failed with err: %+v", volumeId, err)
+			return err
+		} else if volInfo.ID == "" {
+			return NewError(ErrorKindNotFound, "Volume %s not found", volumeId)
+		}
+
+		volume = &Volume{
+			ID:          volInfo.ID,
+			Name:        volInfo.Name,
+			Description: volInfo.Description,
+			DatastoreID: volInfo.DataStoreId,
+			SizeGB:      volInfo.Size,
+			Shared:      volInfo.Shared,
+		}
+		return nil
+	})
 	if err != nil {
-		klog.Errorf("Delete volume %s failed with err: %+v", volumeId, err)
+		return nil, err
+	}
+	return volume, nil
+}
+
+// DeleteVolume deletes a volume given id.
+func (m *volumeManager) DeleteVolume(ctx context.Context, volumeId string, deleteVolume bool) error {
+	err := validateManager(m)
+	if err != nil {
+		return err
+	}
+	err = m.virtualCenter.Connect(ctx)
+	if err != nil {
+		klog.Errorf("Virtual Center Connect failed with err: %+v", err)
 		return err
 	}
 
-	klog.V(5).Infof("Deleting volume %s task info: %+v", volumeId, task)
-	taskState, err := GetTaskState(ctx, m.virtualCenter, &task)
+	taskState, err := m.waitForTask(ctx, taskOperationDelete, volumeId, taskRecord{}, func() (*types.Task, error) {
+		task, err := m.startTask(ctx, func(c *client.Client) (types.Task, error) {
+			return icsvol.NewVolumeService(c).DeleteVolume(ctx, volumeId, deleteVolume)
+		})
+		if err != nil {
+			klog.Errorf("Delete volume %s failed with err: %+v", volumeId, err)
+			return nil, err
+		}
+		klog.V(5).Infof("Deleting volume %s task info: %+v", volumeId, *task)
+		return task, nil
+	})
 	if err != nil {
 		klog.Errorf("Deleting volume %s task failed with err: %+v", volumeId, err)
 		return err
 	} else if taskState != "FINISHED" {
 		errMsg := fmt.Sprintf("Delete volume %s task state %s", volumeId, taskState)
 		klog.Errorf(errMsg)
-		return errors.New(errMsg)
+		return newDriverError(errMsg)
 	}
 	klog.V(5).Infof("Delete volume %s task finished", volumeId)
 	return nil
 }
 
 // ExpandVolume expands a volume given id.
-func (m *volumeManager) ExpandVolume(volumeId string, capacityInGb float64) error {
+func (m *volumeManager) ExpandVolume(ctx context.Context, volumeId string, capacityInGb float64) error {
 	err := validateManager(m)
 	if err != nil {
 		return err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	err = m.virtualCenter.Connect(ctx)
 	if err != nil {
 		klog.Errorf("iCenter Connect failed with err: %+v", err)
 		return err
 	}
 
-	volService := icsvol.NewVolumeService(m.virtualCenter.Client)
-	volInfo, err := volService.GetVolumeInfoById(ctx, volumeId)
-	if err != nil {
-		klog.Errorf("Get volume %s info failed with err: %+v", volumeId, err)
-		return err
-	}
-
-	volInfo.Size = capacityInGb
-	task, err := volService.SetVolume(ctx, volumeId, volInfo)
-	if err != nil {
-		klog.Errorf("Expand volume %s failed with err: %+v", volumeId, err)
-		return err
+	// A recorded task expanding the volume to another size completes before the volume is expanded again
+	if recorded, found := m.tasks.get(taskOperationExpand, volumeId); found && recorded.SizeGB != capacityInGb {
+		_, err = m.resumeTask(ctx, taskOperationExpand, volumeId, recorded.TaskID)
+		if err != nil && ctx.Err() != nil {
+			return err
+		}
 	}
 
-	klog.V(5).Infof("Expanding volume %s task info: %+v", volumeId, task)
-	taskState, err := GetTaskState(ctx, m.virtualCenter, &task)
+	taskState, err := m.waitForTask(ctx, taskOperationExpand, volumeId, taskRecord{SizeGB: capacityInGb}, func() (*types.Task, error) {
+		task, err := m.startTask(ctx, func(c *client.Client) (types.Task, error) {
+			volService := icsvol.NewVolumeService(c)
+			volInfo, err := volService.GetVolumeInfoById(ctx, volumeId)
+			if err != nil {
+				klog.Errorf("Get volume %s info failed with err: %+v", volumeId, err)
+				return types.Task{}, err
+			}
+
+			volInfo.Size = capacityInGb
+			return volService.SetVolume(ctx, volumeId, volInfo)
+		})
+		if err != nil {
+			klog.Errorf("Expand volume %s failed with err: %+v", volumeId, err)
+			return nil, err
+		}
+		klog.V(5).Infof("Expanding volume %s task info: %+v", volumeId, *task)
+		return task, nil
+	})
 	if err != nil {
 		klog.Errorf("Expand volume %s task failed with err: %+v", volumeId, err)
 		return err
 	} else if taskState != "FINISHED" {
 		errMsg := fmt.Sprintf("Expand volume task state %s", taskState)
 		klog.Errorf(errMsg)
-		return errors.New(errMsg)
+		return newDriverError(errMsg)
 	}
 
 	klog.V(5).Infof("Expand volume %s task finished", volumeId)
@@ -205,139 +431,285 @@ func (m *volumeManager) ExpandVolume(volumeId string, capacityInGb float64) erro
 }
 
 // AttachVolume attaches a volume to a virtual machine given the spec.
-func (m *volumeManager) AttachVolume(vm *VirtualMachine, volumeId string) (string, error) {
+func (m *volumeManager) AttachVolume(ctx context.Context, vm *VirtualMachine, volumeId string, spec *DiskSpec) (string, error) {
 	err := validateManager(m)
 	if err != nil {
 		return "", err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	err = m.virtualCenter.Connect(ctx)
 	if err != nil {
 		klog.Errorf("Virtual Center Connect failed with err: %+v", err)
 		return "", err
 	}
 
-	volService := icsvol.NewVolumeService(m.virtualCenter.Client)
-	volInfo, err := volService.GetVolumeInfoById(ctx, volumeId)
-	if err != nil {
-		klog.Errorf("Get volume %s info failed with err: %+v", volumeId, err)
-		return "", err
-	}
-
 	diskInfo := types.Disk{
 		ID:             volumeId,
 		Enabled:        false,
-		Volume:         volInfo,
 		BusModel:       "SCSI",
 		ReadWriteModel: "NONE",
 		EnableNativeIO: false,
 		QueueNum:       1,
 	}
+	err = m.virtualCenter.withSession(ctx, func(c *client.Client) error {
+		var err error
+		diskInfo.Volume, err = icsvol.NewVolumeService(c).GetVolumeInfoById(ctx, volumeId)
+		return err
+	})
+	if err != nil {
+		klog.Errorf("Get volume %s info failed with err: %+v", volumeId, err)
+		return "", err
+	} else if diskInfo.Volume.ID == "" {
+		return "", NewError(ErrorKindNotFound, "Volume %s not found", volumeId)
+	}
+	if spec != nil {
+		diskInfo.BusModel = spec.BusModel
+		diskInfo.ReadWriteModel = spec.CacheMode
+		diskInfo.EnableNativeIO = spec.NativeIO
+		diskInfo.QueueNum = spec.QueueNum
+		diskInfo.TotalIopsSec = spec.MaxIOPS
+		diskInfo.TotalBytesSec = spec.MaxBandwidthMBps * 1024 * 1024
+		diskInfo.TotalIopsSecMax = spec.BurstIOPS
+		diskInfo.TotalBytesSecMax = spec.BurstBandwidthMBps * 1024 * 1024
+	}
+	if diskInfo.BusModel == "SCSI" {
+		diskInfo.Volume.DiskType = "SAS"
+	}
+
+	// Attaches to the same VM are batched into one reconfiguration, which skips
+	// the volume if it is already attached by a previous request
+	klog.V(4).Infof("Attaching volume %s to VM %v with disk spec %v", volumeId, vm, spec)
+	return m.submitDiskChange(ctx, vm, &diskChange{volumeId: volumeId, disk: &diskInfo})
+}
+
+// newDiskReconfiguration returns the VM definition sent to SetVM to replace the disks of the VM.
+// iCenter has no disk-only reconfiguration, so all other settings are sent back as read from
+// iCenter, leaving the floppy media and other settings untouched.
+//
+// SetVM stores VncPasswd as sent, it does not tell a new password from the current one. The
+// console password is sent back as returned by GetVM, which keeps it only if GetVM returns it in
+// clear text. A password masked with '*' would replace the real one with the mask, and a missing
+// one would clear it, so such a VM is not reconfigured. The driver used to reset the password to
+// "00000000" instead.
+func newDiskReconfiguration(vmInfo *types.VirtualMachine, disks []types.Disk) (types.VirtualMachine, error) {
+	if !isClearPassword(vmInfo.VncPasswd) {
+		return types.VirtualMachine{}, NewError(ErrorKindUnknown, "Console password of VM %s is not "+
+			"returned in clear text, reconfiguring its disks would overwrite the password", vmInfo.Name)
+	}
+	reconfiguration := *vmInfo
+	reconfiguration.Disks = disks
+	return reconfiguration, nil
+}
+
+// isClearPassword tells if the password is set and not only made of mask characters.
+func isClearPassword(password string) bool {
+	return strings.Trim(password, "*") != ""
+}
 
-	vmInfo := *vm.VirtualMachine
-	vmInfo.Disks = append(vmInfo.Disks, diskInfo)
-	for _, disk := range vmInfo.Disks {
-		if disk.BusModel == "SCSI" {
-			disk.Volume.DiskType = "SAS"
+// getAttachedDisk returns the disk of the virtual machine backed by the volume,
+// or nil if the volume is not attached to it.
+func getAttachedDisk(vmInfo *types.VirtualMachine, volumeId string) *types.Disk {
+	for i := range vmInfo.Disks {
+		if isVolumeDisk(&vmInfo.Disks[i], volumeId) {
+			return &vmInfo.Disks[i]
 		}
 	}
-	vmInfo.Floppy = nil
-	vmInfo.VncPasswd = "00000000"
-	klog.V(4).Infof("Set floppy config to nil for vm %v", vm)
+	return nil
+}
 
-	klog.V(4).Infof("Attaching volume %s to VM %v", volumeId, vm)
+// isVolumeDisk tells if the disk is backed by the volume.
+func isVolumeDisk(disk *types.Disk, volumeId string) bool {
+	return disk.ID == volumeId || (disk.Volume != nil && disk.Volume.ID == volumeId)
+}
 
-	vmService := icsvm.NewVirtualMachineService(m.virtualCenter.Client)
-	task, err := vmService.SetVM(ctx, vmInfo)
+// DetachVolume detaches a volume from the virtual machine given the spec.
+func (m *volumeManager) DetachVolume(ctx context.Context, vm *VirtualMachine, volumeId string) error {
+	err := validateManager(m)
 	if err != nil {
-		klog.Errorf("Failed to attach volume %s to VM %v with err: %+v", volumeId, vm, err)
-		return "", err
+		return err
+	}
+
+	// Detaches from the same VM are batched into one reconfiguration, which skips
+	// the volume if it is already detached by a previous request
+	klog.V(4).Infof("Detaching volume %s from VM %v", volumeId, vm)
+	_, err = m.submitDiskChange(ctx, vm, &diskChange{volumeId: volumeId})
+	return err
+}
+
+// GetVolumesInDatastore returns all volumes located in the datastore.
+func (m *volumeManager) GetVolumesInDatastore(ctx context.Context, datastoreId string) ([]*Volume, error) {
+	err := validateManager(m)
+	if err != nil {
+		return nil, err
+	}
+	err = m.virtualCenter.Connect(ctx)
+	if err != nil {
+		klog.Errorf("Virtual Center Connect failed with err: %+v", err)
+		return nil, err
 	}
 
-	klog.V(5).Infof("Attach volume %s task info: %+v", volumeId, *task)
+	return m.getVolumesInDatastore(ctx, datastoreId)
+}
+
+// getVolumesInDatastore fetches the volume list of the datastore from iCenter.
+func (m *volumeManager) getVolumesInDatastore(ctx context.Context, datastoreId string) ([]*Volume, error) {
+	var volumes []*Volume
+	err := m.virtualCenter.withSession(ctx, func(c *client.Client) error {
+		volList, err := icsvol.NewVolumeService(c).GetVolumesInDatastore(ctx, datastoreId)
+		if err != nil {
+			return err
+		}
+		for _, volInfo := range volList {
+			volumes = append(volumes,
+				&Volume{
+					ID:          volInfo.ID,
+					Name:        volInfo.Name,
+					Description: volInfo.Description,
+					DatastoreID: datastoreId,
+					SizeGB:      volInfo.Size,
+					Shared:      volInfo.Shared,
+				})
+		}
+		return nil
+	})
+	if err != nil {
+		klog.Errorf("Failed to get volume list in storage %s with err: %+v", datastoreId, err)
+		return nil, err
+	}
+	return volumes, nil
+}
+
+// CreateSnapshot creates a snapshot of the volume with the given name.
+func (m *volumeManager) CreateSnapshot(ctx context.Context, volumeId string, name string) (*VolumeSnapshot, error) {
+	err := validateManager(m)
+	if err != nil {
+		return nil, err
+	}
+	err = m.virtualCenter.Connect(ctx)
+	if err != nil {
+		klog.Errorf("Virtual Center Connect failed with err: %+v", err)
+		return nil, err
+	}
+
+	task, err := m.startTask(ctx, func(c *client.Client) (types.Task, error) {
+		return icsvol.NewVolumeService(c).CreateVolumeSnapshot(ctx, volumeId, name, "CSI Volume Snapshot")
+	})
+	if err != nil {
+		klog.Errorf("Create snapshot %s for volume %s failed with err: %+v", name, volumeId, err)
+		return nil, err
+	}
+
+	klog.V(5).Infof("Creating snapshot %s for volume %s task info: %+v", name, volumeId, *task)
 	taskState, err := GetTaskState(ctx, m.virtualCenter, task)
 	if err != nil {
-		klog.Errorf("Attach volume %s task failed with err: %+v", volumeId, err)
-		return "", err
+		klog.Errorf("Create snapshot %s for volume %s task failed with err: %+v", name, volumeId, err)
+		return nil, err
 	} else if taskState != "FINISHED" {
-		errMsg := fmt.Sprintf("Attach volume %s task state %s", volumeId, taskState)
+		errMsg := fmt.Sprintf("Create snapshot %s for volume %s task state %s", name, volumeId, taskState)
 		klog.Errorf(errMsg)
-		return "", errors.New(errMsg)
+		return nil, newDriverError(errMsg)
 	}
+	klog.V(5).Infof("Create snapshot %s for volume %s task finished", name, volumeId)
 
-	err = vm.Renew(false)
+	snapshots, err := m.getSnapshots(ctx, volumeId)
 	if err != nil {
-		klog.Errorf("Get VM %v info failed with err: %+v", vm, err)
-		return "", err
+		return nil, err
 	}
-
-	for _, diskInfo := range vm.VirtualMachine.Disks {
-		if diskInfo.Volume.ID == volumeId {
-			klog.V(5).Infof("Attach volume %s task finished, disk label %s", volumeId, diskInfo.Label)
-			return diskInfo.Volume.ScsiID, nil
+	for _, snapshot := range snapshots {
+		if snapshot.Name == name {
+			return snapshot, nil
 		}
 	}
 
-	errMsg := fmt.Sprintf("Attach volume %s task failed, volume not found.", volumeId)
+	errMsg := fmt.Sprintf("Snapshot %s not found for volume %s. Create snapshot failed.", name, volumeId)
 	klog.Errorf(errMsg)
-	return "", errors.New(errMsg)
+	return nil, newDriverError(errMsg)
 }
 
-// DetachVolume detaches a volume from the virtual machine given the spec.
-func (m *volumeManager) DetachVolume(vm *VirtualMachine, volumeId string) error {
+// DeleteSnapshot deletes a snapshot of the volume given its id.
+func (m *volumeManager) DeleteSnapshot(ctx context.Context, volumeId string, snapshotId string) error {
 	err := validateManager(m)
 	if err != nil {
 		return err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	err = m.virtualCenter.Connect(ctx)
 	if err != nil {
 		klog.Errorf("Virtual Center Connect failed with err: %+v", err)
 		return err
 	}
 
-	found := false
-	vmInfo := *vm.VirtualMachine
-	for i, disk := range vmInfo.Disks {
-		if disk.ID == volumeId {
-			found = true
-			vmInfo.Disks = append(vmInfo.Disks[:i], vmInfo.Disks[i+1:]...)
-			break
-		}
-	}
-	if !found {
-		errMsg := fmt.Sprintf("Volume %s not found for vm %v", volumeId, vm)
-		klog.Errorf(errMsg)
-		return errors.New(errMsg)
-	}
-
-	vmInfo.Floppy = nil
-	vmInfo.VncPasswd = "00000000"
-	klog.V(4).Infof("Set floppy config to nil for vm %v", vm)
-	klog.V(4).Infof("Detaching volume %s from VM %v", volumeId, vm)
-
-	vmService := icsvm.NewVirtualMachineService(m.virtualCenter.Client)
-	task, err := vmService.SetVM(ctx, vmInfo)
+	task, err := m.startTask(ctx, func(c *client.Client) (types.Task, error) {
+		return icsvol.NewVolumeService(c).DeleteVolumeSnapshot(ctx, volumeId, snapshotId)
+	})
 	if err != nil {
-		klog.Errorf("Failed to detach volume %s from VM %v with err: %+v", volumeId, vm, err)
+		klog.Errorf("Delete snapshot %s of volume %s failed with err: %+v", snapshotId, volumeId, err)
 		return err
 	}
 
-	klog.V(5).Infof("Detach volume %s task info: %+v", volumeId, *task)
+	klog.V(5).Infof("Deleting snapshot %s of volume %s task info: %+v", snapshotId, volumeId, *task)
 	taskState, err := GetTaskState(ctx, m.virtualCenter, task)
 	if err != nil {
-		klog.Errorf("Detach volume %s task failed with err: %+v", volumeId, err)
+		klog.Errorf("Delete snapshot %s of volume %s task failed with err: %+v", snapshotId, volumeId, err)
 		return err
 	} else if taskState != "FINISHED" {
-		errMsg := fmt.Sprintf("Detach volume %s task state %s", volumeId, taskState)
+		errMsg := fmt.Sprintf("Delete snapshot %s of volume %s task state %s", snapshotId, volumeId, taskState)
 		klog.Errorf(errMsg)
-		return errors.New(errMsg)
+		return newDriverError(errMsg)
 	}
-
-	klog.V(5).Infof("Detach volume %s task finished", volumeId)
+	klog.V(5).Infof("Delete snapshot %s of volume %s task finished", snapshotId, volumeId)
 	return nil
 }
+
+// ListSnapshots returns all snapshots of the volume.
+func (m *volumeManager) ListSnapshots(ctx context.Context, volumeId string) ([]*VolumeSnapshot, error) {
+	err := validateManager(m)
+	if err != nil {
+		return nil, err
+	}
+	err = m.virtualCenter.Connect(ctx)
+	if err != nil {
+		klog.Errorf("Virtual Center Connect failed with err: %+v", err)
+		return nil, err
+	}
+	return m.getSnapshots(ctx, volumeId)
+}
+
+// getSnapshots fetches the snapshot list of the volume from iCenter.
+func (m *volumeManager) getSnapshots(ctx context.Context, volumeId string) ([]*VolumeSnapshot, error) {
+	var snapshots []*VolumeSnapshot
+	err := m.virtualCenter.withSession(ctx, func(c *client.Client) error {
+		snapshotList, err := icsvol.NewVolumeService(c).GetVolumeSnapshots(ctx, volumeId)
+		if err != nil {
+			return err
+		}
+		for _, snapshot := range snapshotList {
+			snapshots = append(snapshots,
+				&VolumeSnapshot{
+					ID:         snapshot.ID,
+					Name:       snapshot.Name,
+					VolumeID:   volumeId,
+					SizeGB:     snapshot.Size,
+					CreateTime: time.Unix(0, snapshot.CreateTime*int64(time.Millisecond)),
+				})
+		}
+		return nil
+	})
+	if err != nil {
+		klog.Errorf("Failed to get snapshot list of volume %s with err: %+v", volumeId, err)
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// startTask starts an iCenter task with the client of the current session, see withSession.
+func (m *volumeManager) startTask(ctx context.Context, start func(c *client.Client) (types.Task, error)) (*types.Task, error) {
+	var task types.Task
+	err := m.virtualCenter.withSession(ctx, func(c *client.Client) error {
+		var err error
+		task, err = start(c)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ics
+
+import (
+	"github.com/inspur-ics/ics-go-sdk/client/types"
+	"reflect"
+	"testing"
+)
+
+// newTestVM returns a VM as read from iCenter, with one disk attached and its console
+// password in clear text.
+func newTestVM() *types.VirtualMachine {
+	return &types.VirtualMachine{
+		ID:          "vm-1",
+		Name:        "node-1",
+		Description: "kubernetes node",
+		HostID:      "host-1",
+		HostName:    "host-1.example.com",
+		VncPasswd:   "consolepw",
+		Disks: []types.Disk{
+			{ID: "disk-1", BusModel: "SCSI", ReadWriteModel: "NONE", QueueNum: 1},
+		},
+	}
+}
+
+func TestNewDiskReconfiguration(t *testing.T) {
+	vmInfo := newTestVM()
+	disks := []types.Disk{
+		{ID: "disk-1", BusModel: "SCSI", ReadWriteModel: "NONE", QueueNum: 1},
+		{ID: "volume-1", BusModel: "SCSI", ReadWriteModel: "WRITEBACK", QueueNum: 2},
+	}
+
+	reconfiguration, err := newDiskReconfiguration(vmInfo, disks)
+	if err != nil {
+		t.Fatalf("newDiskReconfiguration failed with err: %v", err)
+	}
+	expected := *newTestVM()
+	expected.Disks = disks
+	if !reflect.DeepEqual(reconfiguration, expected) {
+		t.Errorf("newDiskReconfiguration:\n got %+v\nwant %+v", reconfiguration, expected)
+	}
+	if !reflect.DeepEqual(vmInfo, newTestVM()) {
+		t.Errorf("newDiskReconfiguration modified the VM read from iCenter: %+v", vmInfo)
+	}
+}
+
+func TestNewDiskReconfigurationPassword(t *testing.T) {
+	tests := []struct {
+		password string
+		valid    bool
+	}{
+		{"consolepw", true},
+		{"pass*word", true},
+		{"", false},
+		{"*", false},
+		{"********", false},
+	}
+	for _, test := range tests {
+		vmInfo := newTestVM()
+		vmInfo.VncPasswd = test.password
+		_, err := newDiskReconfiguration(vmInfo, nil)
+		if (err == nil) != test.valid {
+			t.Errorf("newDiskReconfiguration with console password %q returned err: %v", test.password, err)
+		}
+	}
+}
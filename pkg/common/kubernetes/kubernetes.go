@@ -18,6 +18,8 @@ package kubernetes
 
 import (
 	"ics-csi-driver/pkg/csi/service/common"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	clientset "k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
@@ -76,3 +78,77 @@ func GetNodeVMUUID(k8sclient clientset.Interface, nodeName string) (string, erro
 	klog.V(2).Infof("Retrieved node UUID: %q for the node: %q", k8sNodeUUID, nodeName)
 	return k8sNodeUUID, nil
 }
+
+// GetNodeReadiness returns if the Kubernetes node exists and if its Ready condition is true
+func GetNodeReadiness(k8sclient clientset.Interface, nodeName string) (bool, bool, error) {
+	node, err := k8sclient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, false, nil
+	} else if err != nil {
+		klog.Errorf("Failed to get kubernetes node with the name: %q. Err: %v", nodeName, err)
+		return false, false, err
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return true, condition.Status == v1.ConditionTrue, nil
+		}
+	}
+	return true, false, nil
+}
+
+// ConfigMapStore saves data under a key of a ConfigMap, which is created on the first save
+type ConfigMapStore struct {
+	k8sclient clientset.Interface
+	namespace string
+	name      string
+	key       string
+}
+
+// NewConfigMapStore returns a store saving data under the key of the ConfigMap with the name in the namespace
+func NewConfigMapStore(k8sclient clientset.Interface, namespace string, name string, key string) *ConfigMapStore {
+	return &ConfigMapStore{
+		k8sclient: k8sclient,
+		namespace: namespace,
+		name:      name,
+		key:       key,
+	}
+}
+
+// Load returns the data saved in the ConfigMap, or nil if the ConfigMap does not exist
+func (s *ConfigMapStore) Load() ([]byte, error) {
+	configMap, err := s.k8sclient.CoreV1().ConfigMaps(s.namespace).Get(s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		klog.Errorf("Failed to get ConfigMap %s/%s. Err: %v", s.namespace, s.name, err)
+		return nil, err
+	}
+	return []byte(configMap.Data[s.key]), nil
+}
+
+// Save replaces the data saved in the ConfigMap, creating the ConfigMap if it does not exist
+func (s *ConfigMapStore) Save(data []byte) error {
+	configMaps := s.k8sclient.CoreV1().ConfigMaps(s.namespace)
+	configMap, err := configMaps.Get(s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		configMap = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.name,
+				Namespace: s.namespace,
+			},
+			Data: map[string]string{s.key: string(data)},
+		}
+		_, err = configMaps.Create(configMap)
+	} else if err == nil {
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		configMap.Data[s.key] = string(data)
+		_, err = configMaps.Update(configMap)
+	}
+	if err != nil {
+		klog.Errorf("Failed to save ConfigMap %s/%s. Err: %v", s.namespace, s.name, err)
+		return err
+	}
+	return nil
+}
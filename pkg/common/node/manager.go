@@ -17,6 +17,7 @@ limitations under the License.
 package node
 
 import (
+	"context"
 	"errors"
 	"sync"
 
@@ -29,7 +30,7 @@ import (
 
 var (
 	// ErrNodeNotFound is returned when a node isn't found.
-	ErrNodeNotFound = errors.New("node wasn't found")
+	ErrNodeNotFound = ics.NewError(ics.ErrorKindNotFound, "node wasn't found")
 	// ErrEmptyProviderID is returned when it is observed that provider id is not set on the kubernetes cluster
 	ErrEmptyProviderID = errors.New("node with empty providerId present in the cluster")
 )
@@ -46,16 +47,21 @@ type Manager interface {
 	DiscoverNode(nodeUUID string, nodeName string) error
 	//GetNodeUUID return UUID for a node given its nodeName
 	GetNodeUUID(nodeName string) (string, error)
+	// GetNodeNameByUUID returns the name of a registered node given its UUID.
+	GetNodeNameByUUID(nodeUUID string) (string, error)
+	// GetUnregisteredNodeName returns the name of a node unregistered since the
+	// controller started given its UUID, unless it was registered again.
+	GetUnregisteredNodeName(nodeUUID string) (string, error)
 	// GetNode refreshes and returns the VirtualMachine for a registered node
 	// given its UUID.
-	GetNode(nodeUUID string, nodeName string) (*ics.VirtualMachine, error)
+	GetNode(ctx context.Context, nodeUUID string, nodeName string) (*ics.VirtualMachine, error)
 	// GetNodeByName refreshes and returns the VirtualMachine for a registered node
 	// given its name.
-	GetNodeByName(nodeName string) (*ics.VirtualMachine, error)
+	GetNodeByName(ctx context.Context, nodeName string) (*ics.VirtualMachine, error)
 	// GetAllNodes refreshes and returns VirtualMachine for all registered
 	// nodes. If nodes are added or removed concurrently, they may or may not be
 	// reflected in the result of a call to this method.
-	GetAllNodes() ([]*ics.VirtualMachine, error)
+	GetAllNodes(ctx context.Context) ([]*ics.VirtualMachine, error)
 	// UnregisterNode unregisters a registered node given its name.
 	UnregisterNode(nodeName string) error
 }
@@ -88,6 +94,8 @@ type nodeManager struct {
 	nodeVMs sync.Map
 	// node name to node UUI map.
 	nodeNameToUUID sync.Map
+	// unregisteredNodes maps the UUIDs of unregistered nodes to their names.
+	unregisteredNodes sync.Map
 	// k8s client
 	k8sClient clientset.Interface
 }
@@ -100,6 +108,7 @@ func (m *nodeManager) SetKubernetesClient(client clientset.Interface) {
 // RegisterNode registers a node with node manager using its UUID, name.
 func (m *nodeManager) RegisterNode(nodeUUID string, nodeName string) error {
 	m.nodeNameToUUID.Store(nodeName, nodeUUID)
+	m.unregisteredNodes.Delete(nodeUUID)
 	klog.V(2).Infof("Successfully registered node: %q with nodeUUID %q", nodeName, nodeUUID)
 	err := m.DiscoverNode(nodeUUID, nodeName)
 	if err != nil {
@@ -143,16 +152,44 @@ func (m *nodeManager) GetNodeUUID(nodeName string) (string, error) {
 	return k8snodeUUID, nil
 }
 
+// GetNodeNameByUUID returns the name of a registered node given its UUID.
+func (m *nodeManager) GetNodeNameByUUID(nodeUUID string) (string, error) {
+	var nodeName string
+	m.nodeNameToUUID.Range(func(nameInf, uuidInf interface{}) bool {
+		if nameInf != nil && uuidInf != nil && uuidInf.(string) == nodeUUID {
+			nodeName = nameInf.(string)
+			return false
+		}
+		return true
+	})
+	if nodeName == "" {
+		klog.Errorf("Node not found with nodeUUID %s", nodeUUID)
+		return "", ErrNodeNotFound
+	}
+	return nodeName, nil
+}
+
+// GetUnregisteredNodeName returns the name of a node unregistered since the
+// controller started given its UUID, unless it was registered again.
+func (m *nodeManager) GetUnregisteredNodeName(nodeUUID string) (string, error) {
+	nodeName, found := m.unregisteredNodes.Load(nodeUUID)
+	if !found {
+		klog.Errorf("Unregistered node not found with nodeUUID %s", nodeUUID)
+		return "", ErrNodeNotFound
+	}
+	return nodeName.(string), nil
+}
+
 // GetNodeByName refreshes and returns the VirtualMachine for a registered node
 // given its name.
-func (m *nodeManager) GetNodeByName(nodeName string) (*ics.VirtualMachine, error) {
+func (m *nodeManager) GetNodeByName(ctx context.Context, nodeName string) (*ics.VirtualMachine, error) {
 	nodeUUID, found := m.nodeNameToUUID.Load(nodeName)
 	if !found {
 		klog.Errorf("Node not found with nodeName %s", nodeName)
 		return nil, ErrNodeNotFound
 	}
 	if nodeUUID != nil && nodeUUID.(string) != "" {
-		return m.GetNode(nodeUUID.(string), nodeName)
+		return m.GetNode(ctx, nodeUUID.(string), nodeName)
 	}
 	klog.V(2).Infof("Empty nodeUUID observed in cache for the node: %q", nodeName)
 	k8snodeUUID, err := k8s.GetNodeVMUUID(m.k8sClient, nodeName)
@@ -161,12 +198,12 @@ func (m *nodeManager) GetNodeByName(nodeName string) (*ics.VirtualMachine, error
 		return nil, err
 	}
 	m.nodeNameToUUID.Store(nodeName, k8snodeUUID)
-	return m.GetNode(k8snodeUUID, nodeName)
+	return m.GetNode(ctx, k8snodeUUID, nodeName)
 }
 
 // GetNode refreshes and returns the VirtualMachine for a registered node
 // given its UUID
-func (m *nodeManager) GetNode(nodeUUID string, nodeName string) (*ics.VirtualMachine, error) {
+func (m *nodeManager) GetNode(ctx context.Context, nodeUUID string, nodeName string) (*ics.VirtualMachine, error) {
 	vmInf, discovered := m.nodeVMs.Load(nodeUUID)
 	if !discovered {
 		klog.V(2).Infof("Node hasn't been discovered yet with nodeUUID %s", nodeUUID)
@@ -185,7 +222,7 @@ func (m *nodeManager) GetNode(nodeUUID string, nodeName string) (*ics.VirtualMac
 	vm := vmInf.(*ics.VirtualMachine)
 	klog.V(1).Infof("Renewing virtual machine %v with nodeUUID %s", vm, nodeUUID)
 
-	if err := vm.Renew(true); err != nil {
+	if err := vm.Renew(ctx, true); err != nil {
 		klog.Errorf("Failed to renew VM %v with nodeUUID %s with err: %v", vm, nodeUUID, err)
 		return nil, err
 	}
@@ -195,7 +232,7 @@ func (m *nodeManager) GetNode(nodeUUID string, nodeName string) (*ics.VirtualMac
 }
 
 // GetAllNodes refreshes and returns VirtualMachine for all registered nodes.
-func (m *nodeManager) GetAllNodes() ([]*ics.VirtualMachine, error) {
+func (m *nodeManager) GetAllNodes(ctx context.Context) ([]*ics.VirtualMachine, error) {
 	var vms []*ics.VirtualMachine
 	var err error
 	reconnectedHosts := make(map[string]bool)
@@ -235,10 +272,10 @@ func (m *nodeManager) GetAllNodes() ([]*ics.VirtualMachine, error) {
 
 		if reconnectedHosts[vm.VirtualCenterHost] {
 			klog.V(3).Infof("Renewing VM %v, no new connection needed: nodeUUID %s", vm, nodeUUID)
-			err = vm.Renew(false)
+			err = vm.Renew(ctx, false)
 		} else {
 			klog.V(3).Infof("Renewing VM %v with new connection: nodeUUID %s", vm, nodeUUID)
-			err = vm.Renew(true)
+			err = vm.Renew(ctx, true)
 			reconnectedHosts[vm.VirtualCenterHost] = true
 		}
 
@@ -267,6 +304,11 @@ func (m *nodeManager) UnregisterNode(nodeName string) error {
 	}
 	m.nodeNameToUUID.Delete(nodeName)
 	m.nodeVMs.Delete(nodeUUID)
+	// The VM of the node is remembered, so that volumes still attached to it can
+	// be told apart from volumes attached to VMs which never were nodes
+	if nodeUUID != nil && nodeUUID.(string) != "" {
+		m.unregisteredNodes.Store(nodeUUID, nodeName)
+	}
 	klog.V(2).Infof("Successfully unregistered node with nodeName %s", nodeName)
 	return nil
 }
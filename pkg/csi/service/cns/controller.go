@@ -18,16 +18,25 @@ package cns
 
 import (
 	"context"
+	"expvar"
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/klog"
+	"net/http"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"ics-csi-driver/pkg/common/config"
 	"ics-csi-driver/pkg/common/ics"
+	k8s "ics-csi-driver/pkg/common/kubernetes"
 	"ics-csi-driver/pkg/csi/service/common"
 )
 
@@ -37,6 +46,12 @@ var (
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 	}
 )
 
@@ -45,12 +60,22 @@ type nodeManager interface {
 	GetSharedDatastoresInK8SCluster(ctx context.Context) ([]*ics.DatastoreInfo, error)
 	GetSharedDatastoresInTopology(ctx context.Context, topologyRequirement *csi.TopologyRequirement, zoneKey string, regionKey string) ([]*ics.DatastoreInfo, map[string][]map[string]string, error)
 	GetNodeUUID(nodeName string) (string, error)
-	GetNodeByName(nodeName string) (*ics.VirtualMachine, error)
+	GetNodeByName(ctx context.Context, nodeName string) (*ics.VirtualMachine, error)
+	GetAllNodes(ctx context.Context) ([]*ics.VirtualMachine, error)
+	GetNodeNameByUUID(nodeUUID string) (string, error)
+	GetUnregisteredNodeName(nodeUUID string) (string, error)
+	GetNodeReadiness(nodeName string) (bool, bool, error)
 }
 
 type controller struct {
-	manager *common.Manager
-	nodeMgr nodeManager
+	// placementCounter counts datastore selections for the round-robin placement strategy.
+	// It is accessed atomically and kept first for 64-bit alignment.
+	placementCounter uint64
+	manager          *common.Manager
+	nodeMgr          nodeManager
+	// inFlightCreates maps names of volumes being created to a chan struct{}
+	// closed when the creation finishes.
+	inFlightCreates sync.Map
 }
 
 // New creates a CNS controller
@@ -75,10 +100,21 @@ func (c *controller) Init(config *config.Config) error {
 		return err
 	}
 
+	volumeManagerOptions := ics.VolumeManagerOptions{
+		AttachTimeout: time.Duration(config.Global.AttachTimeout) * time.Second,
+		DetachTimeout: time.Duration(config.Global.DetachTimeout) * time.Second,
+	}
+	if config.Global.TaskStoreConfigMap != "" {
+		volumeManagerOptions.TaskStore, err = newTaskStoreBackend(config.Global.TaskStoreConfigMap)
+		if err != nil {
+			klog.Errorf("Failed to set up task store. err=%v", err)
+			return err
+		}
+	}
 	c.manager = &common.Manager{
 		VcenterConfig:  vcenterconfig,
 		CnsConfig:      config,
-		VolumeManager:  ics.GetVolumeManager(vc),
+		VolumeManager:  ics.GetVolumeManager(vc, volumeManagerOptions),
 		VcenterManager: ics.GetVirtualCenterManager(),
 	}
 
@@ -97,9 +133,40 @@ func (c *controller) Init(config *config.Config) error {
 		klog.Errorf("Failed to initialize nodeMgr. err=%v", err)
 		return err
 	}
+
+	if config.Global.MetricsAddress != "" {
+		go serveMetrics(config.Global.MetricsAddress)
+	}
 	return nil
 }
 
+// newTaskStoreBackend returns the backend saving the in-flight iCenter tasks in the
+// ConfigMap with the name, in the namespace of the controller pod.
+func newTaskStoreBackend(name string) (ics.TaskStoreBackend, error) {
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		return nil, fmt.Errorf("POD_NAMESPACE is not set, it is required to record the tasks in ConfigMap %s", name)
+	}
+	k8sclient, err := k8s.NewClient()
+	if err != nil {
+		klog.Errorf("Creating Kubernetes client failed. Err: %v", err)
+		return nil, err
+	}
+	klog.V(2).Infof("Recording in-flight tasks in ConfigMap %s/%s", namespace, name)
+	return k8s.NewConfigMapStore(k8sclient, namespace, name, "tasks.json"), nil
+}
+
+// serveMetrics serves the metrics published with expvar, like the iCenter
+// login and session reuse counts, at /debug/vars on the address
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	klog.Infof("Serving metrics on %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.Errorf("Failed to serve metrics on %s. err=%v", address, err)
+	}
+}
+
 // CreateVolume is creating CNS Volume using volume request specified
 // in CreateVolumeRequest
 func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (
@@ -107,15 +174,43 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 
 	klog.V(4).Infof("CreateVolume: called with args %+v", *req)
 
-	// Volume Size - Default is 10 GiB
-	volSizeBytes := int64(common.DefaultGbDiskSize * common.GbInBytes)
-	if req.GetCapacityRange() != nil && req.GetCapacityRange().RequiredBytes != 0 {
-		volSizeBytes = int64(req.GetCapacityRange().GetRequiredBytes())
+	// Coalesce concurrent requests for the same volume name. A waiting request
+	// runs after the in-flight one finishes and finds the created volume.
+	for {
+		inFlight := make(chan struct{})
+		existing, loaded := c.inFlightCreates.LoadOrStore(req.Name, inFlight)
+		if !loaded {
+			defer func() {
+				c.inFlightCreates.Delete(req.Name)
+				close(inFlight)
+			}()
+			break
+		}
+		klog.V(4).Infof("CreateVolume: waiting for in-flight request of volume %s", req.Name)
+		select {
+		case <-existing.(chan struct{}):
+		case <-ctx.Done():
+			msg := fmt.Sprintf("Stopped waiting for in-flight request of volume %s. Error: %v", req.Name, ctx.Err())
+			klog.Error(msg)
+			return nil, status.Error(common.GetErrorCode(ctx.Err()), msg)
+		}
 	}
-	volSizeGB := int64(common.RoundUpSize(volSizeBytes, common.GbInBytes))
+
+	return c.createVolume(ctx, req)
+}
+
+// createVolume creates the volume specified in CreateVolumeRequest, or
+// returns the existing volume with the same name if it is compatible
+func (c *controller) createVolume(ctx context.Context, req *csi.CreateVolumeRequest) (
+	*csi.CreateVolumeResponse, error) {
 
 	var datastoreReq string
 	var fsType string
+	var cloneMode = common.CloneModeFull
+	var diskFormat string
+	var datastoreOrder = common.DatastoreOrderPriority
+	var minSizeBytes, maxSizeBytes int64
+	var storagePolicyName, storagePolicyID string
 
 	// Support case insensitive parameters
 	for paramName := range req.Parameters {
@@ -124,18 +219,123 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 			datastoreReq = req.Parameters[paramName]
 		} else if param == common.AttributeFsType {
 			fsType = req.Parameters[common.AttributeFsType]
+		} else if param == common.AttributeDiskFormat {
+			diskFormat = strings.ToLower(req.Parameters[paramName])
+			if _, ok := common.DiskFormatVolumePolicies[diskFormat]; !ok {
+				errMsg := fmt.Sprintf("Invalid %s %q specified in the storage class, supported values are %q, %q and %q",
+					common.AttributeDiskFormat, req.Parameters[paramName],
+					common.DiskFormatThin, common.DiskFormatZeroedThick, common.DiskFormatEagerZeroedThick)
+				klog.Errorf(errMsg)
+				return nil, status.Error(codes.InvalidArgument, errMsg)
+			}
+		} else if param == common.AttributeDatastoreOrder {
+			datastoreOrder = strings.ToLower(req.Parameters[paramName])
+			if datastoreOrder != common.DatastoreOrderPriority && datastoreOrder != common.DatastoreOrderBalanced {
+				errMsg := fmt.Sprintf("Invalid %s %q specified in the storage class, supported values are %q and %q",
+					common.AttributeDatastoreOrder, req.Parameters[paramName], common.DatastoreOrderPriority, common.DatastoreOrderBalanced)
+				klog.Errorf(errMsg)
+				return nil, status.Error(codes.InvalidArgument, errMsg)
+			}
+		} else if param == common.AttributeMinSize || param == common.AttributeMaxSize {
+			size, err := resource.ParseQuantity(req.Parameters[paramName])
+			if err != nil || size.Sign() <= 0 {
+				errMsg := fmt.Sprintf("Invalid %s %q specified in the storage class, must be a positive quantity like \"10Gi\"",
+					param, req.Parameters[paramName])
+				klog.Errorf(errMsg)
+				return nil, status.Error(codes.InvalidArgument, errMsg)
+			}
+			if param == common.AttributeMinSize {
+				minSizeBytes = size.Value()
+			} else {
+				maxSizeBytes = size.Value()
+			}
+		} else if param == common.AttributeStoragePolicyName {
+			storagePolicyName = req.Parameters[paramName]
+		} else if param == common.AttributeStoragePolicyID {
+			storagePolicyID = req.Parameters[paramName]
+		} else if param == common.AttributeCloneMode {
+			cloneMode = strings.ToLower(req.Parameters[paramName])
+			if cloneMode != common.CloneModeFull && cloneMode != common.CloneModeLinked {
+				errMsg := fmt.Sprintf("Invalid %s %q specified in the storage class, supported values are %q and %q",
+					common.AttributeCloneMode, req.Parameters[paramName], common.CloneModeFull, common.CloneModeLinked)
+				klog.Errorf(errMsg)
+				return nil, status.Error(codes.InvalidArgument, errMsg)
+			}
 		}
 	}
 
+	if minSizeBytes != 0 && maxSizeBytes != 0 && minSizeBytes > maxSizeBytes {
+		errMsg := fmt.Sprintf("Invalid storage class, %s %d is larger than %s %d",
+			common.AttributeMinSize, minSizeBytes, common.AttributeMaxSize, maxSizeBytes)
+		klog.Errorf(errMsg)
+		return nil, status.Error(codes.InvalidArgument, errMsg)
+	}
+	volSizeMB, err := c.getVolumeSizeMB(req.GetCapacityRange(), minSizeBytes, maxSizeBytes)
+	if err != nil {
+		return nil, err
+	}
+	// QoS limits are kept in the volume context and applied when the volume is attached
+	diskSpec, err := common.GetDiskSpec(req.Parameters)
+	if err != nil {
+		errMsg := fmt.Sprintf("Invalid QoS parameters specified in the storage class. Error: %v", err)
+		klog.Errorf(errMsg)
+		return nil, status.Error(codes.InvalidArgument, errMsg)
+	}
+
 	var createVolumeSpec = common.CreateVolumeSpec{
-		CapacityGB: volSizeGB,
-		Name:       req.Name,
+		CapacityMB:   volSizeMB,
+		Name:         req.Name,
+		MaxSizeBytes: maxSizeBytes,
+	}
+
+	var storagePolicy *ics.StoragePolicy
+	if storagePolicyName != "" || storagePolicyID != "" {
+		storagePolicy, err = c.getStoragePolicy(ctx, storagePolicyName, storagePolicyID)
+		if err != nil {
+			return nil, err
+		}
+		createVolumeSpec.StoragePolicyID = storagePolicy.ID
 	}
 
-	var err error
 	var sharedDatastores []*ics.DatastoreInfo
 	var datastoreTopologyMap = make(map[string][]map[string]string)
 
+	// Datastore of the volume content source, the new volume must be created on it
+	var sourceDatastoreID string
+	if snapshotSource := req.GetVolumeContentSource().GetSnapshot(); snapshotSource != nil {
+		sourceVolume, snapshot, err := c.getSourceSnapshot(ctx, snapshotSource.GetSnapshotId())
+		if err != nil {
+			return nil, err
+		}
+		volSizeMB, err = c.getContentSourceVolumeSize(req, volSizeMB, snapshot.SizeGB, maxSizeBytes)
+		if err != nil {
+			return nil, err
+		}
+		createVolumeSpec.CapacityMB = volSizeMB
+		createVolumeSpec.SourceVolumeID = sourceVolume.ID
+		createVolumeSpec.SourceSnapshotID = snapshot.ID
+		sourceDatastoreID = sourceVolume.DatastoreID
+	} else if volumeSource := req.GetVolumeContentSource().GetVolume(); volumeSource != nil {
+		sourceVolume, err := c.manager.VolumeManager.GetVolume(ctx, volumeSource.GetVolumeId())
+		if err != nil {
+			msg := fmt.Sprintf("Failed to get source volume %q. Error: %+v", volumeSource.GetVolumeId(), err)
+			klog.Error(msg)
+			return nil, status.Error(common.GetErrorCode(err), msg)
+		}
+		volSizeMB, err = c.getContentSourceVolumeSize(req, volSizeMB, sourceVolume.SizeGB, maxSizeBytes)
+		if err != nil {
+			return nil, err
+		}
+		createVolumeSpec.CapacityMB = volSizeMB
+		createVolumeSpec.SourceVolumeID = sourceVolume.ID
+		createVolumeSpec.LinkedClone = cloneMode == common.CloneModeLinked
+		if createVolumeSpec.LinkedClone || (datastoreReq == "" && req.GetAccessibilityRequirements() == nil) {
+			// Linked clones share the disk of the source volume, so they must stay on its datastore.
+			// Full clones default to the source datastore when nothing else is requested.
+			sourceDatastoreID = sourceVolume.DatastoreID
+		}
+	}
+
 	// Get accessibility
 	topologyRequirement := req.GetAccessibilityRequirements()
 	if topologyRequirement != nil {
@@ -162,51 +362,237 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 			return nil, status.Errorf(codes.Internal, msg)
 		}
 	}
+	// Volumes are looked up in all accessible datastores, only compatible ones are used for new volumes
+	accessibleDatastores := sharedDatastores
+	if storagePolicy != nil {
+		var compatibleDatastores []*ics.DatastoreInfo
+		for _, sharedDatastore := range sharedDatastores {
+			if storagePolicy.IsCompatible(sharedDatastore.ID) {
+				compatibleDatastores = append(compatibleDatastores, sharedDatastore)
+			}
+		}
+		if len(compatibleDatastores) == 0 {
+			errMsg := fmt.Sprintf("No datastore compatible with storage policy %q is accessible", storagePolicy.Name)
+			klog.Errorf(errMsg)
+			return nil, status.Error(codes.InvalidArgument, errMsg)
+		}
+		sharedDatastores = compatibleDatastores
+	}
 
+	// Datastores to create the volume on, in the order they are tried
+	var candidateDatastores []*ics.DatastoreInfo
 	if datastoreReq != "" {
-		// Check datastore ID specified in the storageclass is accessible
-		isDataStoreAccessible := false
+		// Check datastores specified in the storageclass are accessible
+		for _, dsReq := range strings.Split(datastoreReq, ",") {
+			dsReq = strings.TrimSpace(dsReq)
+			isDataStoreAccessible := false
+			for _, sharedDatastore := range sharedDatastores {
+				if sharedDatastore.ID == dsReq || sharedDatastore.Name == dsReq {
+					isDataStoreAccessible = true
+					if sourceDatastoreID != "" && sharedDatastore.ID != sourceDatastoreID {
+						klog.V(4).Infof("Skipping datastore %s, volume content source is on datastore %s", dsReq, sourceDatastoreID)
+					} else if diskFormat != "" && !common.IsDiskFormatSupported(sharedDatastore.Type, diskFormat) {
+						klog.V(4).Infof("Skipping datastore %v, %s %q not supported", sharedDatastore, common.AttributeDiskFormat, diskFormat)
+					} else {
+						candidateDatastores = append(candidateDatastores, sharedDatastore)
+					}
+					break
+				}
+			}
+			if !isDataStoreAccessible {
+				klog.V(4).Infof("Skipping datastore %s, not accessible in the topology:[+%v]", dsReq, topologyRequirement)
+			}
+		}
+		if len(candidateDatastores) == 0 {
+			var errMsg string
+			if topologyRequirement != nil {
+				errMsg = fmt.Sprintf("None of datastores: %s specified in the storage class is usable in the topology:[+%v]",
+					datastoreReq, topologyRequirement)
+			} else {
+				errMsg = fmt.Sprintf("None of datastores: %s specified in the storage class is usable", datastoreReq)
+			}
+			klog.Errorf(errMsg)
+			return nil, status.Error(codes.InvalidArgument, errMsg)
+		}
+		if datastoreOrder == common.DatastoreOrderBalanced {
+			sort.SliceStable(candidateDatastores, func(i, j int) bool {
+				return candidateDatastores[i].AvailCapacity > candidateDatastores[j].AvailCapacity
+			})
+		}
+	} else if sourceDatastoreID != "" {
+		// Check datastore of the volume content source is accessible
 		for _, sharedDatastore := range sharedDatastores {
-			if sharedDatastore.ID == datastoreReq || sharedDatastore.Name == datastoreReq {
-				createVolumeSpec.DatastoreID = sharedDatastore.ID
-				isDataStoreAccessible = true
+			if sharedDatastore.ID == sourceDatastoreID {
+				candidateDatastores = append(candidateDatastores, sharedDatastore)
 				break
 			}
 		}
-		if !isDataStoreAccessible {
+		if len(candidateDatastores) == 0 {
 			var errMsg string
 			if topologyRequirement != nil {
-				errMsg = fmt.Sprintf("Datastore: %s specified in the storage class is not accessible in the topology:[+%v]",
-					datastoreReq, topologyRequirement)
+				errMsg = fmt.Sprintf("Datastore: %s of the volume content source is not accessible in the topology:[+%v]",
+					sourceDatastoreID, topologyRequirement)
 			} else {
-				errMsg = fmt.Sprintf("Datastore: %s specified in the storage class is not accessible", datastoreReq)
+				errMsg = fmt.Sprintf("Datastore: %s of the volume content source is not accessible", sourceDatastoreID)
 			}
 			klog.Errorf(errMsg)
 			return nil, status.Error(codes.InvalidArgument, errMsg)
 		}
-	} else if topologyRequirement != nil {
-		sort.Slice(sharedDatastores, func(i, j int) bool { return sharedDatastores[i].AvailCapacity > sharedDatastores[j].AvailCapacity })
-		createVolumeSpec.DatastoreID = sharedDatastores[0].ID
 	} else {
-		errMsg := fmt.Sprintf("Datastore not specified in the storage class. CreateVolumeRequest: %+v", *req)
-		klog.Errorf(errMsg)
-		return nil, status.Error(codes.InvalidArgument, errMsg)
+		// Only consider allowed datastores supporting the requested disk format
+		var allowedDatastores []*ics.DatastoreInfo
+		for _, sharedDatastore := range c.filterAllowedDatastores(sharedDatastores) {
+			if diskFormat == "" || common.IsDiskFormatSupported(sharedDatastore.Type, diskFormat) {
+				allowedDatastores = append(allowedDatastores, sharedDatastore)
+			}
+		}
+		if len(allowedDatastores) == 0 {
+			var errMsg string
+			if topologyRequirement != nil {
+				errMsg = fmt.Sprintf("No allowed datastore supporting %s %q is accessible in the topology:[+%v]",
+					common.AttributeDiskFormat, diskFormat, topologyRequirement)
+			} else {
+				errMsg = fmt.Sprintf("No allowed datastore supporting %s %q is accessible",
+					common.AttributeDiskFormat, diskFormat)
+			}
+			klog.Errorf(errMsg)
+			return nil, status.Error(codes.InvalidArgument, errMsg)
+		}
+		// Prefer the datastores the volume fits in, the capacity check fails below otherwise
+		if fittingDatastores := c.filterDatastoresByCapacity(allowedDatastores, volSizeMB); len(fittingDatastores) > 0 {
+			allowedDatastores = fittingDatastores
+		}
+		candidateDatastores = append(candidateDatastores, c.selectDatastore(allowedDatastores))
 	}
 
-	volumeID, err := common.CreateVolumeUtil(ctx, c.manager, &createVolumeSpec)
+	// Return the existing volume if the request is a retry
+	existingVolume, err := c.getExistingVolume(ctx, req.Name, accessibleDatastores)
 	if err != nil {
-		msg := fmt.Sprintf("Failed to create volume. Error: %+v", err)
+		msg := fmt.Sprintf("Failed to look up existing volume %s. Error: %+v", req.Name, err)
 		klog.Error(msg)
 		return nil, status.Errorf(codes.Internal, msg)
 	}
+	var volumeID string
+	if existingVolume != nil {
+		klog.V(4).Infof("Volume %s already exists: %v", req.Name, existingVolume)
+		var existingDatastore *ics.DatastoreInfo
+		for _, accessibleDatastore := range accessibleDatastores {
+			if accessibleDatastore.ID == existingVolume.DatastoreID {
+				existingDatastore = accessibleDatastore
+				break
+			}
+		}
+		if storagePolicy != nil && !storagePolicy.IsCompatible(existingVolume.DatastoreID) {
+			errMsg := fmt.Sprintf("Volume %s already exists on datastore %s, not compatible with storage policy %q",
+				req.Name, existingVolume.DatastoreID, storagePolicy.Name)
+			klog.Errorf(errMsg)
+			return nil, status.Error(codes.AlreadyExists, errMsg)
+		}
+		if datastoreReq != "" || sourceDatastoreID != "" {
+			isRequestedDatastore := false
+			for _, candidateDatastore := range candidateDatastores {
+				if candidateDatastore.ID == existingVolume.DatastoreID {
+					isRequestedDatastore = true
+					break
+				}
+			}
+			if !isRequestedDatastore {
+				errMsg := fmt.Sprintf("Volume %s already exists on datastore %s, requested datastores %v",
+					req.Name, existingVolume.DatastoreID, candidateDatastores)
+				klog.Errorf(errMsg)
+				return nil, status.Error(codes.AlreadyExists, errMsg)
+			}
+		}
+		existingSizeMB := common.GbToMb(existingVolume.SizeGB)
+		if existingSizeMB < volSizeMB && createVolumeSpec.SourceVolumeID != "" {
+			// Expanding the volume created from the content source was interrupted, finish it
+			err = common.ExpandVolumeUtil(ctx, c.manager, existingVolume.ID, common.MbToGb(volSizeMB))
+			if err != nil {
+				msg := fmt.Sprintf("Failed to expand existing volume %s. Error: %+v", existingVolume.ID, err)
+				klog.Error(msg)
+				return nil, status.Errorf(codes.Internal, msg)
+			}
+			existingSizeMB = volSizeMB
+		}
+		limitBytes := req.GetCapacityRange().GetLimitBytes()
+		if existingSizeMB < volSizeMB || (limitBytes != 0 && existingSizeMB*common.MbInBytes > limitBytes) {
+			errMsg := fmt.Sprintf("Volume %s already exists with size %dMB, requested size %dMB, limit %d bytes",
+				req.Name, existingSizeMB, volSizeMB, limitBytes)
+			klog.Errorf(errMsg)
+			return nil, status.Error(codes.AlreadyExists, errMsg)
+		}
+		volumeID = existingVolume.ID
+		volSizeMB = existingSizeMB
+		createVolumeSpec.DatastoreID = existingVolume.DatastoreID
+		if diskFormat == "" {
+			diskFormat = common.GetDefaultDiskFormat(existingDatastore.Type)
+		}
+	} else {
+		// Check the volume fits in the candidate datastores before creating it
+		fittingDatastores := c.filterDatastoresByCapacity(candidateDatastores, volSizeMB)
+		if len(fittingDatastores) == 0 {
+			errMsg := fmt.Sprintf("Not enough free space for volume %s of %dMB in datastores %v with %d%% reserved",
+				req.Name, volSizeMB, candidateDatastores, c.manager.CnsConfig.Global.DatastoreReservePercent)
+			klog.Errorf(errMsg)
+			return nil, status.Error(codes.ResourceExhausted, errMsg)
+		}
+		// Try the candidate datastores in turn until the volume is created
+		requestedDiskFormat := diskFormat
+		for _, candidateDatastore := range fittingDatastores {
+			// Apply the provisioning policy supported by the type of the datastore
+			diskFormat = requestedDiskFormat
+			if diskFormat == "" {
+				diskFormat = common.GetDefaultDiskFormat(candidateDatastore.Type)
+			}
+			createVolumeSpec.DatastoreID = candidateDatastore.ID
+			createVolumeSpec.DatastoreType = candidateDatastore.Type
+			createVolumeSpec.VolumePolicy = common.DiskFormatVolumePolicies[diskFormat]
+			var volume *ics.Volume
+			volume, err = common.CreateVolumeUtil(ctx, c.manager, &createVolumeSpec)
+			if err == nil {
+				volumeID = volume.ID
+				if volume.DatastoreID != candidateDatastore.ID {
+					// A create task started before the controller restarted was resumed,
+					// the volume is on the datastore the task was started on
+					err = c.useVolumeDatastore(volume, candidateDatastores, &createVolumeSpec)
+					if err != nil {
+						klog.Error(err)
+						return nil, status.Error(codes.Internal, err.Error())
+					}
+					if requestedDiskFormat == "" {
+						diskFormat = common.GetDefaultDiskFormat(createVolumeSpec.DatastoreType)
+					}
+				}
+				break
+			}
+			klog.Warningf("Failed to create volume %s on datastore %v. Error: %+v", req.Name, candidateDatastore, err)
+			// The create task may still complete after a timeout, the retried request
+			// finds the volume instead of creating another one on the next datastore
+			if code := common.GetErrorCode(err); code == codes.DeadlineExceeded || code == codes.Canceled {
+				break
+			}
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Failed to create volume. Error: %+v", err)
+			klog.Error(msg)
+			return nil, status.Errorf(common.GetErrorCode(err), msg)
+		}
+	}
 	attributes := make(map[string]string)
 	attributes[common.AttributeDiskType] = common.DiskTypeString
 	attributes[common.AttributeFsType] = fsType
+	attributes[common.AttributeDiskFormat] = diskFormat
+	common.SetDiskSpecAttributes(attributes, diskSpec)
+	if storagePolicy != nil {
+		attributes[common.AttributeStoragePolicyID] = storagePolicy.ID
+		attributes[common.AttributeStoragePolicyName] = storagePolicy.Name
+	}
 	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volumeID,
-			CapacityBytes: int64(volSizeGB * common.GbInBytes),
+			CapacityBytes: volSizeMB * common.MbInBytes,
 			VolumeContext: attributes,
+			ContentSource: req.GetVolumeContentSource(),
 		},
 	}
 
@@ -219,6 +605,160 @@ func (c *controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 	return resp, nil
 }
 
+// useVolumeDatastore sets the datastore of spec to the datastore the volume is created in,
+// which must be one of the candidate datastores the response topology is built from
+func (c *controller) useVolumeDatastore(volume *ics.Volume, candidateDatastores []*ics.DatastoreInfo,
+	spec *common.CreateVolumeSpec) error {
+	for _, datastore := range candidateDatastores {
+		if datastore.ID == volume.DatastoreID {
+			spec.DatastoreID = datastore.ID
+			spec.DatastoreType = datastore.Type
+			return nil
+		}
+	}
+	return fmt.Errorf("Volume %s is created on datastore %s, which is not one of the requested datastores %v",
+		volume.ID, volume.DatastoreID, candidateDatastores)
+}
+
+// getExistingVolume returns the volume with the given name in the candidate datastores,
+// or nil if no such volume exists
+func (c *controller) getExistingVolume(ctx context.Context, name string, datastores []*ics.DatastoreInfo) (*ics.Volume, error) {
+	searchedDatastores := make(map[string]bool)
+	for _, datastore := range datastores {
+		if searchedDatastores[datastore.ID] {
+			continue
+		}
+		searchedDatastores[datastore.ID] = true
+		volumes, err := c.manager.VolumeManager.GetVolumesInDatastore(ctx, datastore.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, volume := range volumes {
+			if volume.Name == name {
+				return volume, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// getStoragePolicy resolves the storage policy specified by name and/or id in the storage class
+func (c *controller) getStoragePolicy(ctx context.Context, policyName string, policyID string) (*ics.StoragePolicy, error) {
+	vc, err := common.GetVCenter(ctx, c.manager)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get vCenter. Error: %+v", err)
+		klog.Error(msg)
+		return nil, status.Errorf(codes.Internal, msg)
+	}
+	policyIDOrName := policyID
+	if policyIDOrName == "" {
+		policyIDOrName = policyName
+	}
+	policy, err := vc.GetStoragePolicy(ctx, policyIDOrName)
+	if err == ics.ErrStoragePolicyNotFound {
+		errMsg := fmt.Sprintf("Storage policy %q specified in the storage class is not found", policyIDOrName)
+		klog.Errorf(errMsg)
+		return nil, status.Error(codes.InvalidArgument, errMsg)
+	} else if err != nil {
+		msg := fmt.Sprintf("Failed to get storage policy %q. Error: %+v", policyIDOrName, err)
+		klog.Error(msg)
+		return nil, status.Errorf(codes.Internal, msg)
+	}
+	if policyName != "" && policy.Name != policyName {
+		errMsg := fmt.Sprintf("Storage policy %q specified by %s is named %q, not %q",
+			policyID, common.AttributeStoragePolicyID, policy.Name, policyName)
+		klog.Errorf(errMsg)
+		return nil, status.Error(codes.InvalidArgument, errMsg)
+	}
+	return policy, nil
+}
+
+// getVolumeSizeMB returns the size in MiB satisfying the capacity range and the size limits of the
+// storage class, rounded up to the configured granularity. The default size is used when no capacity is requested.
+func (c *controller) getVolumeSizeMB(capacityRange *csi.CapacityRange, minSizeBytes int64, maxSizeBytes int64) (int64, error) {
+	requiredBytes := capacityRange.GetRequiredBytes()
+	limitBytes := capacityRange.GetLimitBytes()
+	if requiredBytes < 0 || limitBytes < 0 || (limitBytes != 0 && requiredBytes > limitBytes) {
+		errMsg := fmt.Sprintf("Invalid capacity range, required %d bytes, limit %d bytes", requiredBytes, limitBytes)
+		klog.Errorf(errMsg)
+		return 0, status.Error(codes.OutOfRange, errMsg)
+	}
+	if requiredBytes == 0 {
+		requiredBytes = common.DefaultGbDiskSize * common.GbInBytes
+		if limitBytes != 0 && limitBytes < requiredBytes {
+			requiredBytes = limitBytes
+		}
+	}
+	if requiredBytes < minSizeBytes {
+		requiredBytes = minSizeBytes
+	}
+	granularityMB := int64(c.manager.CnsConfig.Global.VolumeSizeGranularityMB)
+	volSizeMB := common.RoundUpSize(requiredBytes, granularityMB*common.MbInBytes) * granularityMB
+	if limitBytes != 0 && volSizeMB*common.MbInBytes > limitBytes {
+		errMsg := fmt.Sprintf("No volume size in multiples of %dMB between %d and %d bytes",
+			granularityMB, requiredBytes, limitBytes)
+		klog.Errorf(errMsg)
+		return 0, status.Error(codes.OutOfRange, errMsg)
+	}
+	if maxSizeBytes != 0 && volSizeMB*common.MbInBytes > maxSizeBytes {
+		errMsg := fmt.Sprintf("Volume size %dMB exceeds %s %d bytes of the storage class",
+			volSizeMB, common.AttributeMaxSize, maxSizeBytes)
+		klog.Errorf(errMsg)
+		return 0, status.Error(codes.OutOfRange, errMsg)
+	}
+	return volSizeMB, nil
+}
+
+// getContentSourceVolumeSize returns the size of the volume to create from a content source of sourceSizeGB.
+// The source size is used when no capacity is requested, a requested size smaller than the source is rejected.
+func (c *controller) getContentSourceVolumeSize(req *csi.CreateVolumeRequest, volSizeMB int64, sourceSizeGB float64,
+	maxSizeBytes int64) (int64, error) {
+	granularityMB := int64(c.manager.CnsConfig.Global.VolumeSizeGranularityMB)
+	sourceVolSizeMB := common.RoundUpSize(common.GbToMb(sourceSizeGB), granularityMB) * granularityMB
+	if volSizeMB >= sourceVolSizeMB {
+		return volSizeMB, nil
+	}
+	limitBytes := req.GetCapacityRange().GetLimitBytes()
+	if req.GetCapacityRange().GetRequiredBytes() != 0 ||
+		(limitBytes != 0 && sourceVolSizeMB*common.MbInBytes > limitBytes) ||
+		(maxSizeBytes != 0 && sourceVolSizeMB*common.MbInBytes > maxSizeBytes) {
+		errMsg := fmt.Sprintf("Requested size %dMB does not fit the size %dMB of the volume content source %+v",
+			volSizeMB, sourceVolSizeMB, req.GetVolumeContentSource())
+		klog.Errorf(errMsg)
+		return 0, status.Error(codes.OutOfRange, errMsg)
+	}
+	return sourceVolSizeMB, nil
+}
+
+// getSourceSnapshot returns the source volume and the snapshot for the given CSI snapshot id
+func (c *controller) getSourceSnapshot(ctx context.Context, csiSnapshotID string) (*ics.Volume, *ics.VolumeSnapshot, error) {
+	volumeID, snapshotID, err := common.ParseSnapshotID(csiSnapshotID)
+	if err != nil {
+		klog.Error(err)
+		return nil, nil, status.Error(codes.NotFound, err.Error())
+	}
+	volume, err := c.manager.VolumeManager.GetVolume(ctx, volumeID)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get source volume %q of snapshot %q. Error: %+v", volumeID, csiSnapshotID, err)
+		klog.Error(msg)
+		return nil, nil, status.Error(common.GetErrorCode(err), msg)
+	}
+	snapshots, err := c.manager.VolumeManager.ListSnapshots(ctx, volumeID)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to list snapshots of volume: %q. Error: %+v", volumeID, err)
+		klog.Error(msg)
+		return nil, nil, status.Errorf(codes.Internal, msg)
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.ID == snapshotID {
+			return volume, snapshot, nil
+		}
+	}
+	msg := fmt.Sprintf("Snapshot %q not found", csiSnapshotID)
+	klog.Error(msg)
+	return nil, nil, status.Error(codes.NotFound, msg)
+}
+
 // CreateVolume is deleting CNS Volume specified in DeleteVolumeRequest
 func (c *controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (
 	*csi.DeleteVolumeResponse, error) {
@@ -232,14 +772,27 @@ func (c *controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequ
 	}
 	err = common.DeleteVolumeUtil(ctx, c.manager, req.VolumeId, true)
 	if err != nil {
+		code := common.GetErrorCode(err)
+		if code == codes.NotFound && c.isVolumeDeleted(ctx, req.VolumeId) {
+			// Volume is already gone, deleting it again succeeds
+			klog.V(2).Infof("Volume %q not found, assuming it is deleted. Error: %+v", req.VolumeId, err)
+			return &csi.DeleteVolumeResponse{}, nil
+		}
 		msg := fmt.Sprintf("Failed to delete volume: %q. Error: %+v", req.VolumeId, err)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(code, msg)
 	}
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// isVolumeDeleted checks the volume no longer exists. A delete failing as not found may
+// also be about the task deleting the volume, so the volume itself is looked up.
+func (c *controller) isVolumeDeleted(ctx context.Context, volumeID string) bool {
+	_, err := c.manager.VolumeManager.GetVolume(ctx, volumeID)
+	return err != nil && common.GetErrorCode(err) == codes.NotFound
+}
+
 // ControllerPublishVolume attaches a volume to the Node VM.
 // volume id and node name is retrieved from ControllerPublishVolumeRequest
 func (c *controller) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (
@@ -252,22 +805,40 @@ func (c *controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 		klog.Error(msg)
 		return nil, status.Errorf(codes.Internal, msg)
 	}
-	node, err := c.nodeMgr.GetNodeByName(req.NodeId)
+	node, err := c.nodeMgr.GetNodeByName(ctx, req.NodeId)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to find VirtualMachine for node:%q. Error: %v", req.NodeId, err)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(common.GetErrorCode(err), msg)
 	}
 	klog.V(4).Infof("Found VirtualMachine for node:%q.", req.NodeId)
 
-	diskUUID, err := common.AttachVolumeUtil(ctx, c.manager, node, req.VolumeId)
+	diskSpec, err := common.GetDiskSpec(req.GetVolumeContext())
+	if err != nil {
+		msg := fmt.Sprintf("Invalid QoS settings in volume context of volume %q. Error: %v", req.VolumeId, err)
+		klog.Error(msg)
+		return nil, status.Errorf(codes.InvalidArgument, msg)
+	}
+
+	// Volumes published on a single node must not stay attached to another node
+	if !isMultiNodeVolumeCapability(req.GetVolumeCapability()) {
+		err = c.ensureVolumeNotAttachedElsewhere(ctx, req.VolumeId, node)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	diskUUID, err := common.AttachVolumeUtil(ctx, c.manager, node, req.VolumeId, diskSpec)
 	if err != nil {
-		klog.Errorf("ControllerPublishVolume: failed with err: %v", err)
+		msg := fmt.Sprintf("Failed to attach disk: %+q to node: %q err: %+v", req.VolumeId, req.NodeId, err)
+		klog.Error(msg)
+		return nil, status.Errorf(common.GetErrorCode(err), msg)
 	}
 
 	publishInfo := make(map[string]string)
 	publishInfo[common.AttributeDiskType] = common.DiskTypeString
 	publishInfo[common.AttributeFirstClassDiskUUID] = diskUUID
+	common.SetDiskSpecAttributes(publishInfo, diskSpec)
 	resp := &csi.ControllerPublishVolumeResponse{
 		PublishContext: publishInfo,
 	}
@@ -286,17 +857,17 @@ func (c *controller) ControllerUnpublishVolume(ctx context.Context, req *csi.Con
 		klog.Error(msg)
 		return nil, status.Errorf(codes.Internal, msg)
 	}
-	node, err := c.nodeMgr.GetNodeByName(req.NodeId)
+	node, err := c.nodeMgr.GetNodeByName(ctx, req.NodeId)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to find VirtualMachine for node:%q. Error: %v", req.NodeId, err)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(common.GetErrorCode(err), msg)
 	}
 	err = common.DetachVolumeUtil(ctx, c.manager, node, req.VolumeId)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to detach disk: %+q from node: %q err: %+v", req.VolumeId, req.NodeId, err)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(common.GetErrorCode(err), msg)
 	}
 
 	resp := &csi.ControllerUnpublishVolumeResponse{}
@@ -308,21 +879,212 @@ func (c *controller) ValidateVolumeCapabilities(ctx context.Context, req *csi.Va
 	*csi.ValidateVolumeCapabilitiesResponse, error) {
 
 	klog.V(4).Infof("ValidateVolumeCapabilities: called with args %+v", *req)
-	return nil, status.Error(codes.Unimplemented, "")
+
+	err := common.ValidateVolumeCapabilitiesRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	volume, err := c.manager.VolumeManager.GetVolume(ctx, req.VolumeId)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get volume: %q. Error: %+v", req.VolumeId, err)
+		klog.Error(msg)
+		return nil, status.Error(common.GetErrorCode(err), msg)
+	}
+
+	err = common.ValidateVolumeCapabilitiesForVolume(req.VolumeCapabilities, volume.Shared)
+	if err != nil {
+		msg := fmt.Sprintf("Volume capabilities not supported by volume %v: %v", volume, err)
+		klog.V(4).Info(msg)
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: msg}, nil
+	}
+
+	resp := &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.VolumeContext,
+			VolumeCapabilities: req.VolumeCapabilities,
+			Parameters:         req.Parameters,
+		},
+	}
+	return resp, nil
 }
 
+// ListVolumes returns the volumes created by the driver in the configured datacenters
 func (c *controller) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 	*csi.ListVolumesResponse, error) {
 
 	klog.V(4).Infof("ListVolumes: called with args %+v", *req)
-	return nil, status.Error(codes.Unimplemented, "")
+
+	volumes, err := c.listCSIVolumes(ctx)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to list volumes. Error: %+v", err)
+		klog.Error(msg)
+		return nil, status.Errorf(codes.Internal, msg)
+	}
+
+	start := 0
+	if req.StartingToken != "" {
+		start, err = strconv.Atoi(req.StartingToken)
+		if err != nil || start < 0 || start > len(volumes) {
+			msg := fmt.Sprintf("Invalid starting token %q", req.StartingToken)
+			klog.Error(msg)
+			return nil, status.Error(codes.Aborted, msg)
+		}
+	}
+	end := len(volumes)
+	if req.MaxEntries > 0 && start+int(req.MaxEntries) < end {
+		end = start + int(req.MaxEntries)
+	}
+
+	publishedNodes, err := c.getPublishedNodes(ctx)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get published nodes of volumes. Error: %+v", err)
+		klog.Error(msg)
+		return nil, status.Errorf(codes.Internal, msg)
+	}
+
+	resp := &csi.ListVolumesResponse{}
+	for _, volume := range volumes[start:end] {
+		resp.Entries = append(resp.Entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      volume.ID,
+				CapacityBytes: int64(volume.SizeGB * float64(common.GbInBytes)),
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: publishedNodes[volume.ID],
+			},
+		})
+	}
+	if end < len(volumes) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+	return resp, nil
+}
+
+// listCSIVolumes returns the volumes created by the driver in the configured datacenters, sorted by id
+func (c *controller) listCSIVolumes(ctx context.Context) ([]*ics.Volume, error) {
+	vc, err := common.GetVCenter(ctx, c.manager)
+	if err != nil {
+		return nil, err
+	}
+	dcs, err := vc.GetDatacenters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []*ics.Volume
+	listedDatastores := make(map[string]bool)
+	for _, dc := range dcs {
+		datastores, err := dc.GetAllDatastores(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, datastore := range datastores {
+			if listedDatastores[datastore.ID] {
+				continue
+			}
+			listedDatastores[datastore.ID] = true
+			datastoreVolumes, err := c.manager.VolumeManager.GetVolumesInDatastore(ctx, datastore.ID)
+			if err != nil {
+				return nil, err
+			}
+			for _, volume := range datastoreVolumes {
+				if common.IsVolumeDescription(volume.Description) {
+					volumes = append(volumes, volume)
+				}
+			}
+		}
+	}
+	// Sort to keep the order stable between paginated calls
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].ID < volumes[j].ID })
+	return volumes, nil
+}
+
+// getPublishedNodes returns the map of volume id to names of the nodes the volume is attached to
+func (c *controller) getPublishedNodes(ctx context.Context) (map[string][]string, error) {
+	nodeVMs, err := c.nodeMgr.GetAllNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	publishedNodes := make(map[string][]string)
+	for _, nodeVM := range nodeVMs {
+		nodeName, err := c.nodeMgr.GetNodeNameByUUID(nodeVM.UUID)
+		if err != nil {
+			klog.Warningf("Failed to get node name of VM %v, skipping its disks. err: %v", nodeVM, err)
+			continue
+		}
+		for _, disk := range nodeVM.VirtualMachine.Disks {
+			if disk.Volume == nil {
+				// Disks which are not backed by a volume are not published
+				continue
+			}
+			publishedNodes[disk.Volume.ID] = append(publishedNodes[disk.Volume.ID], nodeName)
+		}
+	}
+	return publishedNodes, nil
 }
 
+// GetCapacity returns the available capacity of the datastores accessible in the
+// topology segment specified in GetCapacityRequest
 func (c *controller) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (
 	*csi.GetCapacityResponse, error) {
 
 	klog.V(4).Infof("GetCapacity: called with args %+v", *req)
-	return nil, status.Error(codes.Unimplemented, "")
+
+	var datastoreReq string
+	// Support case insensitive parameters
+	for paramName := range req.Parameters {
+		if strings.ToLower(paramName) == common.AttributeDatastoreURL {
+			datastoreReq = req.Parameters[paramName]
+		}
+	}
+
+	var err error
+	var datastores []*ics.DatastoreInfo
+	if req.GetAccessibleTopology() != nil {
+		if c.manager.CnsConfig.Labels.Zone == "" || c.manager.CnsConfig.Labels.Region == "" {
+			// if zone and region label not specified in the config secret, then return NotFound error.
+			errMsg := fmt.Sprintf("Zone/Region category names not specified in the csi config secret")
+			klog.Errorf(errMsg)
+			return nil, status.Error(codes.NotFound, errMsg)
+		}
+		topologyRequirement := &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{req.GetAccessibleTopology()},
+		}
+		datastores, _, err = c.nodeMgr.GetSharedDatastoresInTopology(ctx, topologyRequirement, c.manager.CnsConfig.Labels.Zone, c.manager.CnsConfig.Labels.Region)
+	} else {
+		datastores, err = c.nodeMgr.GetSharedDatastoresInK8SCluster(ctx)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Failed to get shared datastores for topology: %+v. Error: %+v", req.GetAccessibleTopology(), err)
+		klog.Error(msg)
+		return nil, status.Errorf(codes.Internal, msg)
+	}
+
+	requestedDatastores := make(map[string]bool)
+	if datastoreReq != "" {
+		for _, dsReq := range strings.Split(datastoreReq, ",") {
+			requestedDatastores[strings.TrimSpace(dsReq)] = true
+		}
+	}
+	// A datastore may be listed once per matching topology segment, count it only once
+	var availableGB float64
+	countedDatastores := make(map[string]bool)
+	for _, datastore := range datastores {
+		if countedDatastores[datastore.ID] {
+			continue
+		}
+		if datastoreReq != "" && !requestedDatastores[datastore.ID] && !requestedDatastores[datastore.Name] {
+			continue
+		}
+		countedDatastores[datastore.ID] = true
+		availableGB += c.availableCapacity(datastore)
+	}
+
+	resp := &csi.GetCapacityResponse{
+		AvailableCapacity: int64(availableGB * float64(common.GbInBytes)),
+	}
+	klog.V(4).Infof("GetCapacity: resp %+v", *resp)
+	return resp, nil
 }
 
 func (c *controller) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (
@@ -343,25 +1105,225 @@ func (c *controller) ControllerGetCapabilities(ctx context.Context, req *csi.Con
 	return &csi.ControllerGetCapabilitiesResponse{Capabilities: caps}, nil
 }
 
+// CreateSnapshot creates a snapshot of the source volume specified in CreateSnapshotRequest
 func (c *controller) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (
 	*csi.CreateSnapshotResponse, error) {
 
 	klog.V(4).Infof("CreateSnapshot: called with args %+v", *req)
-	return nil, status.Error(codes.Unimplemented, "")
+
+	err := common.ValidateCreateSnapshotRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Return the existing snapshot if the request is a retry
+	snapshots, err := c.manager.VolumeManager.ListSnapshots(ctx, req.SourceVolumeId)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to list snapshots of volume: %q. Error: %+v", req.SourceVolumeId, err)
+		klog.Error(msg)
+		return nil, status.Errorf(common.GetErrorCode(err), msg)
+	}
+	var snapshot *ics.VolumeSnapshot
+	for _, s := range snapshots {
+		if s.Name == req.Name {
+			klog.V(4).Infof("Snapshot %s already exists for volume %s: %v", req.Name, req.SourceVolumeId, s)
+			snapshot = s
+			break
+		}
+	}
+
+	if snapshot == nil {
+		// Snapshot names are unique across volumes, a name taken on another volume is not a retry
+		allSnapshots, err := c.listAllSnapshots(ctx)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to list snapshots. Error: %+v", err)
+			klog.Error(msg)
+			return nil, status.Errorf(common.GetErrorCode(err), msg)
+		}
+		for _, s := range allSnapshots {
+			if s.Name == req.Name && s.VolumeID != req.SourceVolumeId {
+				msg := fmt.Sprintf("Snapshot %s already exists for another volume %s", req.Name, s.VolumeID)
+				klog.Error(msg)
+				return nil, status.Error(codes.AlreadyExists, msg)
+			}
+		}
+		snapshot, err = common.CreateSnapshotUtil(ctx, c.manager, req.SourceVolumeId, req.Name)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to create snapshot %s for volume: %q. Error: %+v", req.Name, req.SourceVolumeId, err)
+			klog.Error(msg)
+			return nil, status.Errorf(common.GetErrorCode(err), msg)
+		}
+	}
+
+	csiSnapshot, err := getCsiSnapshot(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	resp := &csi.CreateSnapshotResponse{
+		Snapshot: csiSnapshot,
+	}
+	klog.V(4).Infof("CreateSnapshot: resp %+v", *resp)
+	return resp, nil
 }
 
+// DeleteSnapshot deletes the snapshot specified in DeleteSnapshotRequest
 func (c *controller) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (
 	*csi.DeleteSnapshotResponse, error) {
 
 	klog.V(4).Infof("DeleteSnapshot: called with args %+v", *req)
-	return nil, status.Error(codes.Unimplemented, "")
+
+	err := common.ValidateDeleteSnapshotRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	volumeID, snapshotID, err := common.ParseSnapshotID(req.SnapshotId)
+	if err != nil {
+		// A snapshot id not created by this driver can not exist, so there is nothing to delete
+		klog.Warningf("DeleteSnapshot: %v, assuming snapshot is already deleted", err)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	snapshots, err := c.manager.VolumeManager.ListSnapshots(ctx, volumeID)
+	if err != nil {
+		code := common.GetErrorCode(err)
+		if code == codes.NotFound {
+			klog.V(4).Infof("Volume %s of snapshot %s not found, assuming it is already deleted", volumeID, snapshotID)
+			return &csi.DeleteSnapshotResponse{}, nil
+		}
+		msg := fmt.Sprintf("Failed to list snapshots of volume: %q. Error: %+v", volumeID, err)
+		klog.Error(msg)
+		return nil, status.Errorf(code, msg)
+	}
+	found := false
+	for _, snapshot := range snapshots {
+		if snapshot.ID == snapshotID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		klog.V(4).Infof("Snapshot %s of volume %s not found, assuming it is already deleted", snapshotID, volumeID)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	err = common.DeleteSnapshotUtil(ctx, c.manager, volumeID, snapshotID)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to delete snapshot: %q. Error: %+v", req.SnapshotId, err)
+		klog.Error(msg)
+		return nil, status.Errorf(common.GetErrorCode(err), msg)
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
+// ListSnapshots returns the snapshots matching the filters specified in ListSnapshotsRequest
 func (c *controller) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (
 	*csi.ListSnapshotsResponse, error) {
 
 	klog.V(4).Infof("ListSnapshots: called with args %+v", *req)
-	return nil, status.Error(codes.Unimplemented, "")
+
+	var err error
+	var snapshots []*ics.VolumeSnapshot
+	if req.SnapshotId != "" {
+		volumeID, snapshotID, err := common.ParseSnapshotID(req.SnapshotId)
+		if err != nil {
+			klog.Warningf("ListSnapshots: %v, returning empty list", err)
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		volumeSnapshots, err := c.manager.VolumeManager.ListSnapshots(ctx, volumeID)
+		if err != nil && common.GetErrorCode(err) == codes.NotFound {
+			klog.V(4).Infof("ListSnapshots: volume %s not found, returning empty list", volumeID)
+			return &csi.ListSnapshotsResponse{}, nil
+		} else if err != nil {
+			msg := fmt.Sprintf("Failed to list snapshots of volume: %q. Error: %+v", volumeID, err)
+			klog.Error(msg)
+			return nil, status.Errorf(common.GetErrorCode(err), msg)
+		}
+		for _, snapshot := range volumeSnapshots {
+			if snapshot.ID == snapshotID {
+				snapshots = append(snapshots, snapshot)
+				break
+			}
+		}
+	} else if req.SourceVolumeId != "" {
+		snapshots, err = c.manager.VolumeManager.ListSnapshots(ctx, req.SourceVolumeId)
+		if err != nil && common.GetErrorCode(err) == codes.NotFound {
+			klog.V(4).Infof("ListSnapshots: volume %s not found, returning empty list", req.SourceVolumeId)
+			return &csi.ListSnapshotsResponse{}, nil
+		} else if err != nil {
+			msg := fmt.Sprintf("Failed to list snapshots of volume: %q. Error: %+v", req.SourceVolumeId, err)
+			klog.Error(msg)
+			return nil, status.Errorf(common.GetErrorCode(err), msg)
+		}
+	} else {
+		snapshots, err = c.listAllSnapshots(ctx)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to list snapshots. Error: %+v", err)
+			klog.Error(msg)
+			return nil, status.Errorf(common.GetErrorCode(err), msg)
+		}
+	}
+
+	start := 0
+	if req.StartingToken != "" {
+		start, err = strconv.Atoi(req.StartingToken)
+		if err != nil || start < 0 || start > len(snapshots) {
+			msg := fmt.Sprintf("Invalid starting token %q", req.StartingToken)
+			klog.Error(msg)
+			return nil, status.Error(codes.Aborted, msg)
+		}
+	}
+	end := len(snapshots)
+	if req.MaxEntries > 0 && start+int(req.MaxEntries) < end {
+		end = start + int(req.MaxEntries)
+	}
+
+	resp := &csi.ListSnapshotsResponse{}
+	for _, snapshot := range snapshots[start:end] {
+		csiSnapshot, err := getCsiSnapshot(snapshot)
+		if err != nil {
+			return nil, err
+		}
+		resp.Entries = append(resp.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: csiSnapshot})
+	}
+	if end < len(snapshots) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+	return resp, nil
+}
+
+// listAllSnapshots returns snapshots of all volumes created by the driver
+func (c *controller) listAllSnapshots(ctx context.Context) ([]*ics.VolumeSnapshot, error) {
+	volumes, err := c.listCSIVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*ics.VolumeSnapshot
+	for _, volume := range volumes {
+		volumeSnapshots, err := c.manager.VolumeManager.ListSnapshots(ctx, volume.ID)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, volumeSnapshots...)
+	}
+	return snapshots, nil
+}
+
+// getCsiSnapshot converts the iCenter volume snapshot to csi.Snapshot
+func getCsiSnapshot(snapshot *ics.VolumeSnapshot) (*csi.Snapshot, error) {
+	creationTime, err := ptypes.TimestampProto(snapshot.CreateTime)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to convert creation time of snapshot %v. Error: %+v", snapshot, err)
+		klog.Error(msg)
+		return nil, status.Errorf(codes.Internal, msg)
+	}
+	return &csi.Snapshot{
+		SnapshotId:     common.GetSnapshotID(snapshot.VolumeID, snapshot.ID),
+		SourceVolumeId: snapshot.VolumeID,
+		SizeBytes:      int64(snapshot.SizeGB * float64(common.GbInBytes)),
+		CreationTime:   creationTime,
+		ReadyToUse:     true,
+	}, nil
 }
 
 func (c *controller) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (
@@ -369,15 +1331,32 @@ func (c *controller) ControllerExpandVolume(ctx context.Context, req *csi.Contro
 
 	klog.V(5).Infof("ControllerExpandVolume: called with args %+v", *req)
 
+	err := common.ValidateControllerExpandVolumeRequest(req)
+	if err != nil {
+		return nil, err
+	}
 	volumeID := req.GetVolumeId()
-	volSizeBytes := int64(req.GetCapacityRange().GetRequiredBytes())
-	volSizeGB := float64(common.RoundUpSize(volSizeBytes, common.GbInBytes))
-
-	err := common.ExpandVolumeUtil(ctx, c.manager, volumeID, volSizeGB)
+	volume, err := c.manager.VolumeManager.GetVolume(ctx, volumeID)
 	if err != nil {
-		msg := fmt.Sprintf("failed to expand volume: %q to size: %d with error: %+v", volumeID, volSizeGB, err)
+		msg := fmt.Sprintf("failed to get volume: %q with error: %+v", volumeID, err)
 		klog.Error(msg)
-		return nil, status.Errorf(codes.Internal, msg)
+		return nil, status.Errorf(common.GetErrorCode(err), msg)
+	}
+	// The maxsize of the storage class applies to expansions too, minsize is met already
+	volSizeMB, err := c.getVolumeSizeMB(req.GetCapacityRange(), 0, common.GetVolumeMaxSize(volume.Description))
+	if err != nil {
+		return nil, err
+	}
+	if currentSizeMB := common.GbToMb(volume.SizeGB); currentSizeMB >= volSizeMB {
+		klog.V(4).Infof("ControllerExpandVolume: volume %q of %dMB is already at least %dMB", volumeID, currentSizeMB, volSizeMB)
+		volSizeMB = currentSizeMB
+	} else {
+		err = common.ExpandVolumeUtil(ctx, c.manager, volumeID, common.MbToGb(volSizeMB))
+		if err != nil {
+			msg := fmt.Sprintf("failed to expand volume: %q to size: %dMB with error: %+v", volumeID, volSizeMB, err)
+			klog.Error(msg)
+			return nil, status.Errorf(common.GetErrorCode(err), msg)
+		}
 	}
 
 	nodeExpansionRequired := true
@@ -386,7 +1365,7 @@ func (c *controller) ControllerExpandVolume(ctx context.Context, req *csi.Contro
 		nodeExpansionRequired = false
 	}
 	resp := &csi.ControllerExpandVolumeResponse{
-		CapacityBytes:         int64(volSizeGB * float64(common.GbInBytes)),
+		CapacityBytes:         volSizeMB * common.MbInBytes,
 		NodeExpansionRequired: nodeExpansionRequired,
 	}
 
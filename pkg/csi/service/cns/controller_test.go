@@ -0,0 +1,69 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"ics-csi-driver/pkg/common/config"
+	"ics-csi-driver/pkg/csi/service/common"
+)
+
+// newTestController returns a controller with the given configuration and no iCenter.
+func newTestController(cfg *config.Config) *controller {
+	return &controller{manager: &common.Manager{CnsConfig: cfg}}
+}
+
+func TestGetVolumeSizeMB(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Global.VolumeSizeGranularityMB = config.DefaultVolumeSizeGranularityMB
+	c := newTestController(cfg)
+	gb := common.GbInBytes
+	tests := []struct {
+		name         string
+		required     int64
+		limit        int64
+		minSizeBytes int64
+		maxSizeBytes int64
+		expectedMB   int64
+		expectedCode codes.Code
+	}{
+		{"default size", 0, 0, 0, 0, common.DefaultGbDiskSize * 1024, codes.OK},
+		{"default size within limit", 0, 5 * gb, 0, 0, 5 * 1024, codes.OK},
+		{"rounded up", gb + 1, 0, 0, 0, 2 * 1024, codes.OK},
+		{"minimum size", gb, 0, 3 * gb, 0, 3 * 1024, codes.OK},
+		{"maximum size", 20 * gb, 0, 0, 20 * gb, 20 * 1024, codes.OK},
+		{"above maximum size", 21 * gb, 0, 0, 20 * gb, 0, codes.OutOfRange},
+		{"minimum above limit", gb, 2 * gb, 3 * gb, 0, 0, codes.OutOfRange},
+		{"no size in range", gb + 1, gb + 2, 0, 0, 0, codes.OutOfRange},
+		{"required above limit", 2 * gb, gb, 0, 0, 0, codes.OutOfRange},
+		{"negative size", -1, 0, 0, 0, 0, codes.OutOfRange},
+	}
+	for _, test := range tests {
+		capacityRange := &csi.CapacityRange{RequiredBytes: test.required, LimitBytes: test.limit}
+		sizeMB, err := c.getVolumeSizeMB(capacityRange, test.minSizeBytes, test.maxSizeBytes)
+		if code := status.Code(err); code != test.expectedCode {
+			t.Errorf("%s: getVolumeSizeMB returned code %v, want %v, err: %v", test.name, code, test.expectedCode, err)
+		} else if sizeMB != test.expectedMB {
+			t.Errorf("%s: getVolumeSizeMB = %dMB, want %dMB", test.name, sizeMB, test.expectedMB)
+		}
+	}
+}
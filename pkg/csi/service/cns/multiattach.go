@@ -0,0 +1,139 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+
+	"ics-csi-driver/pkg/common/config"
+	"ics-csi-driver/pkg/common/ics"
+	"ics-csi-driver/pkg/csi/service/common"
+)
+
+// isMultiNodeVolumeCapability tells if the volume capability allows the volume
+// to be published on multiple nodes at the same time
+func isMultiNodeVolumeCapability(volCap *csi.VolumeCapability) bool {
+	switch volCap.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		return true
+	}
+	return false
+}
+
+// getVolumeOwners returns the virtual machines other than the node the volume is attached to
+func (c *controller) getVolumeOwners(ctx context.Context, volumeID string, node *ics.VirtualMachine) (
+	[]*ics.VirtualMachine, error) {
+	vc, err := common.GetVCenter(ctx, c.manager)
+	if err != nil {
+		return nil, err
+	}
+	dcs, err := vc.GetDatacenters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var owners []*ics.VirtualMachine
+	for _, dc := range dcs {
+		vms, err := dc.GetVirtualMachinesByVolume(ctx, volumeID)
+		if err != nil {
+			return nil, err
+		}
+		for _, vm := range vms {
+			if vm.UUID != node.UUID {
+				owners = append(owners, vm)
+			}
+		}
+	}
+	return owners, nil
+}
+
+// isNodeGone tells if the kubernetes node is deleted or NotReady.
+func (c *controller) isNodeGone(nodeName string) (bool, error) {
+	exists, ready, err := c.nodeMgr.GetNodeReadiness(nodeName)
+	if err != nil {
+		return false, err
+	}
+	return !exists || !ready, nil
+}
+
+// getOwnerNodeName returns the name of the kubernetes node of the virtual machine, which is
+// either registered or was unregistered when the node was deleted.
+func (c *controller) getOwnerNodeName(owner *ics.VirtualMachine) (string, error) {
+	nodeName, err := c.nodeMgr.GetNodeNameByUUID(owner.UUID)
+	if err == nil {
+		return nodeName, nil
+	}
+	return c.nodeMgr.GetUnregisteredNodeName(owner.UUID)
+}
+
+// ensureVolumeNotAttachedElsewhere checks the volume is not attached to any virtual machine
+// other than the node. Depending on the multi-attach policy, it is detached from virtual machines
+// of nodes which are NotReady or deleted, otherwise FailedPrecondition is returned. Nodes deleted
+// before the controller started are not known, the volume is not detached from their VMs.
+func (c *controller) ensureVolumeNotAttachedElsewhere(ctx context.Context, volumeID string,
+	node *ics.VirtualMachine) error {
+	owners, err := c.getVolumeOwners(ctx, volumeID, node)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to find VirtualMachines volume %q is attached to. Error: %+v", volumeID, err)
+		klog.Error(msg)
+		return status.Errorf(common.GetErrorCode(err), msg)
+	}
+	for _, owner := range owners {
+		if c.manager.CnsConfig.Global.MultiAttachPolicy != config.MultiAttachForceDetach {
+			msg := fmt.Sprintf("Volume %q is still attached to VirtualMachine %v", volumeID, owner)
+			klog.Error(msg)
+			return status.Error(codes.FailedPrecondition, msg)
+		}
+		// Only virtual machines of known nodes are force detached, never other virtual machines
+		nodeName, err := c.getOwnerNodeName(owner)
+		if err != nil {
+			msg := fmt.Sprintf("Volume %q is still attached to VirtualMachine %v which is not a known node. Error: %+v",
+				volumeID, owner, err)
+			klog.Error(msg)
+			return status.Error(codes.FailedPrecondition, msg)
+		}
+		gone, err := c.isNodeGone(nodeName)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to get status of node %q. Error: %+v", nodeName, err)
+			klog.Error(msg)
+			return status.Errorf(codes.Internal, msg)
+		}
+		if !gone {
+			msg := fmt.Sprintf("Volume %q is still attached to VirtualMachine %v of Ready node %q",
+				volumeID, owner, nodeName)
+			klog.Error(msg)
+			return status.Error(codes.FailedPrecondition, msg)
+		}
+		klog.Warningf("Force detaching volume %q from VirtualMachine %v of NotReady or deleted node %q",
+			volumeID, owner, nodeName)
+		err = common.DetachVolumeUtil(ctx, c.manager, owner, volumeID)
+		if err != nil {
+			msg := fmt.Sprintf("Failed to force detach volume %q from VirtualMachine %v. Error: %+v",
+				volumeID, owner, err)
+			klog.Error(msg)
+			return status.Errorf(common.GetErrorCode(err), msg)
+		}
+	}
+	return nil
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	v1 "k8s.io/api/core/v1"
+	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 	"strings"
 
@@ -34,6 +35,7 @@ import (
 type Nodes struct {
 	cnsNodeManager cnsnode.Manager
 	informMgr      *k8s.InformerManager
+	k8sclient      clientset.Interface
 }
 
 // Initialize helps initialize node manager and node informer manager
@@ -45,6 +47,7 @@ func (nodes *Nodes) Initialize() error {
 		klog.Errorf("Creating Kubernetes client failed. Err: %v", err)
 		return err
 	}
+	nodes.k8sclient = k8sclient
 	nodes.cnsNodeManager.SetKubernetesClient(k8sclient)
 	nodes.informMgr = k8s.NewInformer(k8sclient)
 	nodes.informMgr.AddNodeListener(nodes.nodeAdd, nil, nodes.nodeDelete)
@@ -91,8 +94,28 @@ func (nodes *Nodes) GetNodeUUID(nodeName string) (string, error) {
 
 // GetNodeByName returns VirtualMachine object for given nodeName
 // This is called by ControllerPublishVolume and ControllerUnpublishVolume to perform attach and detach operations.
-func (nodes *Nodes) GetNodeByName(nodeName string) (*ics.VirtualMachine, error) {
-	return nodes.cnsNodeManager.GetNodeByName(nodeName)
+func (nodes *Nodes) GetNodeByName(ctx context.Context, nodeName string) (*ics.VirtualMachine, error) {
+	return nodes.cnsNodeManager.GetNodeByName(ctx, nodeName)
+}
+
+// GetAllNodes returns VirtualMachine objects for all registered nodes
+func (nodes *Nodes) GetAllNodes(ctx context.Context) ([]*ics.VirtualMachine, error) {
+	return nodes.cnsNodeManager.GetAllNodes(ctx)
+}
+
+// GetNodeNameByUUID returns the kubernetes node name for given node VM UUID
+func (nodes *Nodes) GetNodeNameByUUID(nodeUUID string) (string, error) {
+	return nodes.cnsNodeManager.GetNodeNameByUUID(nodeUUID)
+}
+
+// GetUnregisteredNodeName returns the kubernetes node name for given VM UUID of a deleted node
+func (nodes *Nodes) GetUnregisteredNodeName(nodeUUID string) (string, error) {
+	return nodes.cnsNodeManager.GetUnregisteredNodeName(nodeUUID)
+}
+
+// GetNodeReadiness returns if the kubernetes node exists and if it is Ready
+func (nodes *Nodes) GetNodeReadiness(nodeName string) (bool, bool, error) {
+	return k8s.GetNodeReadiness(nodes.k8sclient, nodeName)
 }
 
 // GetSharedDatastoresInTopology returns shared accessible datastores for specified topologyRequirement along with the map of
@@ -117,7 +140,7 @@ func (nodes *Nodes) GetNodeByName(nodeName string) (*ics.VirtualMachine, error)
 //         map[failure-domain.beta.kubernetes.io/region:k8s-region-us failure-domain.beta.kubernetes.io/zone:k8s-zone-us-east]]]]
 func (nodes *Nodes) GetSharedDatastoresInTopology(ctx context.Context, topologyRequirement *csi.TopologyRequirement, zoneCategoryName string, regionCategoryName string) ([]*ics.DatastoreInfo, map[string][]map[string]string, error) {
 	klog.V(4).Infof("GetSharedDatastoresInTopology: called with topologyRequirement: %+v, zoneCategoryName: %s, regionCategoryName: %s", topologyRequirement, zoneCategoryName, regionCategoryName)
-	allNodes, err := nodes.cnsNodeManager.GetAllNodes()
+	allNodes, err := nodes.cnsNodeManager.GetAllNodes(ctx)
 	if err != nil {
 		klog.Errorf("Failed to get Nodes from nodeManager with err %+v", err)
 		return nil, nil, err
@@ -209,7 +232,7 @@ func (nodes *Nodes) GetSharedDatastoresInTopology(ctx context.Context, topologyR
 // GetSharedDatastoresInK8SCluster returns list of DatastoreInfo objects for datastores accessible to all
 // kubernetes nodes in the cluster.
 func (nodes *Nodes) GetSharedDatastoresInK8SCluster(ctx context.Context) ([]*ics.DatastoreInfo, error) {
-	nodeVMs, err := nodes.cnsNodeManager.GetAllNodes()
+	nodeVMs, err := nodes.cnsNodeManager.GetAllNodes(ctx)
 	if err != nil {
 		klog.Errorf("Failed to get Nodes from nodeManager with err %+v", err)
 		return nil, err
@@ -0,0 +1,108 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"k8s.io/klog"
+
+	"ics-csi-driver/pkg/common/config"
+	"ics-csi-driver/pkg/common/ics"
+	"ics-csi-driver/pkg/csi/service/common"
+)
+
+// filterAllowedDatastores returns the datastores in the allow-list configured
+// in the Global section. All datastores are returned if the allow-list is empty.
+func (c *controller) filterAllowedDatastores(datastores []*ics.DatastoreInfo) []*ics.DatastoreInfo {
+	if strings.TrimSpace(c.manager.CnsConfig.Global.Datastores) == "" {
+		return datastores
+	}
+	allowed := make(map[string]bool)
+	for _, ds := range strings.Split(c.manager.CnsConfig.Global.Datastores, ",") {
+		allowed[strings.TrimSpace(ds)] = true
+	}
+	var allowedDatastores []*ics.DatastoreInfo
+	for _, datastore := range datastores {
+		if allowed[datastore.ID] || allowed[datastore.Name] {
+			allowedDatastores = append(allowedDatastores, datastore)
+		}
+	}
+	return allowedDatastores
+}
+
+// selectDatastore returns the datastore picked from the candidates by the
+// placement strategy configured in the Global section.
+func (c *controller) selectDatastore(candidates []*ics.DatastoreInfo) *ics.DatastoreInfo {
+	if len(candidates) == 0 {
+		return nil
+	}
+	datastores := make([]*ics.DatastoreInfo, len(candidates))
+	copy(datastores, candidates)
+
+	strategy := c.manager.CnsConfig.Global.DatastorePlacement
+	switch strategy {
+	case config.PlacementUsage:
+		sort.SliceStable(datastores, func(i, j int) bool {
+			return usedPercent(datastores[i]) < usedPercent(datastores[j])
+		})
+	case config.PlacementRoundRobin:
+		sort.Slice(datastores, func(i, j int) bool { return datastores[i].ID < datastores[j].ID })
+		next := atomic.AddUint64(&c.placementCounter, 1) - 1
+		datastores[0] = datastores[next%uint64(len(datastores))]
+	default:
+		sort.SliceStable(datastores, func(i, j int) bool {
+			return datastores[i].AvailCapacity > datastores[j].AvailCapacity
+		})
+	}
+	klog.V(4).Infof("Datastore %v selected by placement strategy %q", datastores[0], strategy)
+	return datastores[0]
+}
+
+// availableCapacity returns the free space of the datastore in GB, less the
+// reserve configured in the Global section.
+func (c *controller) availableCapacity(datastore *ics.DatastoreInfo) float64 {
+	reserve := datastore.Capacity * float64(c.manager.CnsConfig.Global.DatastoreReservePercent) / 100
+	if datastore.AvailCapacity <= reserve {
+		return 0
+	}
+	return datastore.AvailCapacity - reserve
+}
+
+// filterDatastoresByCapacity returns the datastores which can hold a volume
+// of the given size without using the reserve.
+func (c *controller) filterDatastoresByCapacity(datastores []*ics.DatastoreInfo, volSizeMB int64) []*ics.DatastoreInfo {
+	var fittingDatastores []*ics.DatastoreInfo
+	for _, datastore := range datastores {
+		if c.availableCapacity(datastore) >= common.MbToGb(volSizeMB) {
+			fittingDatastores = append(fittingDatastores, datastore)
+		} else {
+			klog.V(4).Infof("Datastore %v has not enough free space for %dMB", datastore, volSizeMB)
+		}
+	}
+	return fittingDatastores
+}
+
+// usedPercent returns the used percentage of the datastore capacity
+func usedPercent(datastore *ics.DatastoreInfo) float64 {
+	if datastore.Capacity <= 0 {
+		return 100
+	}
+	return (datastore.Capacity - datastore.AvailCapacity) * 100 / datastore.Capacity
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cns
+
+import (
+	"testing"
+
+	"ics-csi-driver/pkg/common/config"
+	"ics-csi-driver/pkg/common/ics"
+)
+
+func newTestDatastores() []*ics.DatastoreInfo {
+	return []*ics.DatastoreInfo{
+		{ID: "datastore-1", Name: "small", Capacity: 100, AvailCapacity: 60},
+		{ID: "datastore-2", Name: "large", Capacity: 1000, AvailCapacity: 300},
+		{ID: "datastore-3", Name: "empty", Capacity: 200, AvailCapacity: 190},
+	}
+}
+
+func TestSelectDatastore(t *testing.T) {
+	tests := []struct {
+		strategy string
+		expected []string
+	}{
+		{config.PlacementFreeSpace, []string{"datastore-2", "datastore-2"}},
+		{config.PlacementUsage, []string{"datastore-3", "datastore-3"}},
+		{config.PlacementRoundRobin, []string{"datastore-1", "datastore-2", "datastore-3", "datastore-1"}},
+	}
+	for _, test := range tests {
+		cfg := &config.Config{}
+		cfg.Global.DatastorePlacement = test.strategy
+		c := newTestController(cfg)
+		for i, expected := range test.expected {
+			if datastore := c.selectDatastore(newTestDatastores()); datastore == nil || datastore.ID != expected {
+				t.Errorf("%s: selection %d = %v, want %s", test.strategy, i, datastore, expected)
+			}
+		}
+	}
+	if datastore := newTestController(&config.Config{}).selectDatastore(nil); datastore != nil {
+		t.Errorf("selectDatastore without candidates = %v", datastore)
+	}
+}
+
+func TestFilterDatastoresByCapacity(t *testing.T) {
+	tests := []struct {
+		reservePercent int
+		volSizeMB      int64
+		expected       []string
+	}{
+		{0, 60 * 1024, []string{"datastore-1", "datastore-2", "datastore-3"}},
+		{0, 61 * 1024, []string{"datastore-2", "datastore-3"}},
+		{10, 50 * 1024, []string{"datastore-1", "datastore-2", "datastore-3"}},
+		{10, 51 * 1024, []string{"datastore-2", "datastore-3"}},
+		{50, 100 * 1024, []string{}},
+	}
+	for _, test := range tests {
+		cfg := &config.Config{}
+		cfg.Global.DatastoreReservePercent = test.reservePercent
+		datastores := newTestController(cfg).filterDatastoresByCapacity(newTestDatastores(), test.volSizeMB)
+		ids := []string{}
+		for _, datastore := range datastores {
+			ids = append(ids, datastore.ID)
+		}
+		if len(ids) != len(test.expected) {
+			t.Errorf("reserve %d%%, %dMB: datastores %v, want %v", test.reservePercent, test.volSizeMB, ids, test.expected)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != test.expected[i] {
+				t.Errorf("reserve %d%%, %dMB: datastores %v, want %v", test.reservePercent, test.volSizeMB, ids, test.expected)
+				break
+			}
+		}
+	}
+}
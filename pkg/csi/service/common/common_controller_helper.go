@@ -104,6 +104,70 @@ func ValidateControllerUnpublishVolumeRequest(req *csi.ControllerUnpublishVolume
 	return nil
 }
 
+// ValidateVolumeCapabilitiesRequest is the helper function to validate
+// ValidateVolumeCapabilitiesRequest for all block controllers.
+// Function returns error if validation fails otherwise returns nil.
+func ValidateVolumeCapabilitiesRequest(req *csi.ValidateVolumeCapabilitiesRequest) error {
+	//check for required parameters
+	if len(req.VolumeId) == 0 {
+		msg := "Volume ID is a required parameter."
+		klog.Error(msg)
+		return status.Error(codes.InvalidArgument, msg)
+	} else if len(req.VolumeCapabilities) == 0 {
+		msg := "Volume capabilities not provided"
+		klog.Error(msg)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// ValidateCreateSnapshotRequest is the helper function to validate
+// CreateSnapshotRequest for all block controllers.
+// Function returns error if validation fails otherwise returns nil.
+func ValidateCreateSnapshotRequest(req *csi.CreateSnapshotRequest) error {
+	//check for required parameters
+	if len(req.Name) == 0 {
+		msg := "Snapshot name is a required parameter."
+		klog.Error(msg)
+		return status.Error(codes.InvalidArgument, msg)
+	} else if len(req.SourceVolumeId) == 0 {
+		msg := "Source volume ID is a required parameter."
+		klog.Error(msg)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// ValidateDeleteSnapshotRequest is the helper function to validate
+// DeleteSnapshotRequest for all block controllers.
+// Function returns error if validation fails otherwise returns nil.
+func ValidateDeleteSnapshotRequest(req *csi.DeleteSnapshotRequest) error {
+	//check for required parameters
+	if len(req.SnapshotId) == 0 {
+		msg := "Snapshot ID is a required parameter."
+		klog.Error(msg)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
+// ValidateControllerExpandVolumeRequest is the helper function to validate
+// ControllerExpandVolumeRequest for all block controllers.
+// Function returns error if validation fails otherwise returns nil.
+func ValidateControllerExpandVolumeRequest(req *csi.ControllerExpandVolumeRequest) error {
+	//check for required parameters
+	if len(req.VolumeId) == 0 {
+		msg := "Volume ID is a required parameter."
+		klog.Error(msg)
+		return status.Error(codes.InvalidArgument, msg)
+	} else if req.GetCapacityRange().GetRequiredBytes() <= 0 {
+		msg := "Capacity range with required bytes is a required parameter."
+		klog.Error(msg)
+		return status.Error(codes.InvalidArgument, msg)
+	}
+	return nil
+}
+
 // CheckAPI checks if specified version is 6.7.3 or higher
 func CheckAPI(version string) error {
 	items := strings.Split(version, ".")
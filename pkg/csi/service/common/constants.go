@@ -26,18 +26,34 @@ const (
 	// DefaultGbDiskSize is the default disk size in gibibytes.
 	DefaultGbDiskSize = int64(10)
 
+	// MbInGb is the number of mebibytes in one gibibyte.
+	MbInGb = int64(1024)
+
 	// DiskTypeString is the value for the PersistentVolume's attribute "type"
 	DiskTypeString = "InCloudSphere CNS Block Volume"
 
+	// VolumeDescription is the description of volumes created by the CSI driver
+	VolumeDescription = "CSI Persistent Volume"
+
 	// AttributeDiskType is a PersistentVolume's attribute.
 	AttributeDiskType = "type"
 
-	// AttributeDatastoreURL represents URL of the datastore in the StorageClass
-	// For Example: DatastoreURL: "ds:///vmfs/volumes/5c9bb20e-009c1e46-4b85-0200483b2a97/"
+	// AttributeDatastoreURL represents comma separated IDs or names of the datastores in the StorageClass
+	// For Example: DatastoreURL: "8ab0b28d77be994a0177bea19e1d0078,8ab0b28d77be994a0177bea19e1d0079"
 	AttributeDatastoreURL = "datastoreurl"
 
+	// AttributeDatastoreOrder represents the order datastores listed in DatastoreURL are tried in
+	// For Example: DatastoreOrder: "balanced"
+	AttributeDatastoreOrder = "datastoreorder"
+
+	// DatastoreOrderPriority tries the datastores in the listed order
+	DatastoreOrderPriority = "priority"
+
+	// DatastoreOrderBalanced tries the datastores with the most free space first
+	DatastoreOrderBalanced = "balanced"
+
 	// AttributeStoragePolicyName represents name of the Storage Policy in the Storage Class
-	// For Example: StoragePolicy: "vSAN Default Storage Policy"
+	// For Example: StoragePolicy: "gold"
 	AttributeStoragePolicyName = "storagepolicyname"
 
 	// AttributeStoragePolicyID represents Storage Policy Id in the Storage Classs
@@ -48,6 +64,103 @@ const (
 	// For Example: FsType: "ext4"
 	AttributeFsType = "fstype"
 
+	// AttributeDiskFormat represents the provisioning policy of the disk in the Storage Class
+	// For Example: DiskFormat: "eagerzeroedthick"
+	AttributeDiskFormat = "diskformat"
+
+	// DiskFormatThin allocates disk space on demand
+	DiskFormatThin = "thin"
+
+	// DiskFormatZeroedThick allocates all disk space at creation and zeroes it on first write
+	DiskFormatZeroedThick = "zeroedthick"
+
+	// DiskFormatEagerZeroedThick allocates and zeroes all disk space at creation
+	DiskFormatEagerZeroedThick = "eagerzeroedthick"
+
+	// DefaultDiskFormat is the disk format used if user does not specify it in the Storage Class
+	// and the datastore type has no specific default
+	DefaultDiskFormat = DiskFormatThin
+
+	// DatastoreTypeLocal is the iCenter type of host local datastores
+	DatastoreTypeLocal = "LOCAL"
+
+	// DatastoreTypeNFS is the iCenter type of NFS datastores
+	DatastoreTypeNFS = "NFS"
+
+	// DatastoreTypeISCSI is the iCenter type of iSCSI datastores
+	DatastoreTypeISCSI = "ISCSI"
+
+	// DatastoreTypeFC is the iCenter type of Fibre Channel datastores
+	DatastoreTypeFC = "FC"
+
+	// DatastoreTypeDistributed is the iCenter type of distributed datastores
+	DatastoreTypeDistributed = "VSTOR"
+
+	// AttributeCloneMode represents how a volume is cloned from a PVC data source in the Storage Class
+	// For Example: CloneMode: "linked"
+	AttributeCloneMode = "clonemode"
+
+	// CloneModeFull copies all data of the source volume to the clone
+	CloneModeFull = "full"
+
+	// CloneModeLinked creates a clone sharing the disk of the source volume
+	CloneModeLinked = "linked"
+
+	// AttributeMinSize represents the minimum size of volumes in the Storage Class, smaller requests are rounded up
+	// For Example: MinSize: "1Gi"
+	AttributeMinSize = "minsize"
+
+	// AttributeMaxSize represents the maximum size of volumes in the Storage Class, larger requests are rejected
+	// For Example: MaxSize: "2Ti"
+	AttributeMaxSize = "maxsize"
+
+	// AttributeMaxIOPS represents the I/O operations per second limit of the volume in the Storage Class
+	// For Example: MaxIOPS: "1000"
+	AttributeMaxIOPS = "maxiops"
+
+	// AttributeMaxBandwidth represents the throughput limit of the volume in MiB per second in the Storage Class
+	// For Example: MaxBandwidthMBps: "100"
+	AttributeMaxBandwidth = "maxbandwidthmbps"
+
+	// AttributeBurstIOPS represents the I/O operations per second allowed for short bursts in the Storage Class
+	// For Example: BurstIOPS: "2000"
+	AttributeBurstIOPS = "burstiops"
+
+	// AttributeBurstBandwidth represents the throughput in MiB per second allowed for short bursts in the Storage Class
+	// For Example: BurstBandwidthMBps: "200"
+	AttributeBurstBandwidth = "burstbandwidthmbps"
+
+	// AttributeBusModel represents the bus the volume is attached to nodes with in the Storage Class
+	// For Example: BusModel: "scsi"
+	AttributeBusModel = "busmodel"
+
+	// DiskBusSCSI attaches the volume as a SCSI disk
+	DiskBusSCSI = "SCSI"
+
+	// AttributeCacheMode represents the host cache mode of the attached volume in the Storage Class
+	// For Example: CacheMode: "writeback"
+	AttributeCacheMode = "cachemode"
+
+	// DiskCacheNone bypasses the host cache
+	DiskCacheNone = "NONE"
+
+	// DiskCacheWriteBack caches reads and writes in the host
+	DiskCacheWriteBack = "WRITEBACK"
+
+	// DiskCacheWriteThrough caches reads in the host and writes through to the disk
+	DiskCacheWriteThrough = "WRITETHROUGH"
+
+	// AttributeNativeIO represents if the attached volume uses native asynchronous IO in the Storage Class
+	// For Example: NativeIO: "true"
+	AttributeNativeIO = "nativeio"
+
+	// AttributeQueueCount represents the number of IO queues of the attached volume in the Storage Class
+	// For Example: QueueCount: "4"
+	AttributeQueueCount = "queuecount"
+
+	// MaxDiskQueueCount is the maximum number of IO queues of an attached volume
+	MaxDiskQueueCount = 32
+
 	// DefaultFsType represents the default filesystem type which will be used to format the volume
 	// during mount if user does not specify the filesystem type in the Storage Class
 	DefaultFsType = "ext4"
@@ -62,6 +175,11 @@ const (
 	// BlockVolumeType is the VolumeType for CNS Volume
 	BlockVolumeType = "BLOCK"
 
+	// SnapshotIDSeparator separates the volume id and the iCenter snapshot id
+	// in a CSI snapshot id.
+	// Example: 8ab0b28d77be994a0177bea19e1d0078+8ab0b28d77be994a0177bea19e1d0080
+	SnapshotIDSeparator = "+"
+
 	// MinSupportedVCenterMajor is the minimum, major version of vCenter
 	// on which CNS is supported.
 	MinSupportedVCenterMajor int = 6
@@ -32,6 +32,37 @@ var (
 			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
 		},
 	}
+
+	// SharedVolumeCaps represents the additional access modes of shared volumes.
+	// Shared ICS volumes could be attached to multiple nodes, but only as raw
+	// block devices since the filesystems formatted by the driver are not cluster aware.
+	SharedVolumeCaps = []csi.VolumeCapability_AccessMode{
+		{
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		},
+		{
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		},
+	}
+
+	// DiskFormatVolumePolicies maps the disk formats supported in the Storage Class
+	// to the iCenter volume policies.
+	DiskFormatVolumePolicies = map[string]string{
+		DiskFormatThin:             "THIN",
+		DiskFormatZeroedThick:      "THICK",
+		DiskFormatEagerZeroedThick: "THICK_EAGER",
+	}
+
+	// DatastoreTypeDiskFormats maps the iCenter datastore types to the disk formats
+	// they support. The first disk format is the default for the datastore type.
+	// File and distributed datastores allocate space on demand and only support thin disks.
+	DatastoreTypeDiskFormats = map[string][]string{
+		DatastoreTypeLocal:       {DiskFormatThin, DiskFormatZeroedThick, DiskFormatEagerZeroedThick},
+		DatastoreTypeISCSI:       {DiskFormatThin, DiskFormatZeroedThick, DiskFormatEagerZeroedThick},
+		DatastoreTypeFC:          {DiskFormatThin, DiskFormatZeroedThick, DiskFormatEagerZeroedThick},
+		DatastoreTypeNFS:         {DiskFormatThin},
+		DatastoreTypeDistributed: {DiskFormatThin},
+	}
 )
 
 // Controller is the interface for the CSI Controller Server plus extra methods
@@ -53,5 +84,20 @@ type Manager struct {
 type CreateVolumeSpec struct {
 	Name        string
 	DatastoreID string
-	CapacityGB  int64
+	// CapacityMB is the size of the volume in mebibytes
+	CapacityMB int64
+	// DatastoreType is the iCenter type of the datastore the volume is created on
+	DatastoreType string
+	// VolumePolicy is the iCenter provisioning policy of the volume
+	VolumePolicy string
+	// SourceVolumeID is the id of the volume the new volume is populated from
+	SourceVolumeID string
+	// SourceSnapshotID is the iCenter id of the snapshot the new volume is restored from
+	SourceSnapshotID string
+	// StoragePolicyID is the id of the iCenter storage policy applied to the volume
+	StoragePolicyID string
+	// LinkedClone tells if the volume is cloned as a linked clone of the source volume
+	LinkedClone bool
+	// MaxSizeBytes is the maxsize of the storage class, which the volume is not expanded beyond
+	MaxSizeBytes int64
 }
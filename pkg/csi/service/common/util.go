@@ -18,40 +18,85 @@ package common
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/inspur-ics/ics-go-sdk/client/types"
+	"google.golang.org/grpc/codes"
 	"ics-csi-driver/pkg/common/ics"
 	"k8s.io/klog"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// CreateVolumeUtil is the helper function to create CNS volume
-func CreateVolumeUtil(ctx context.Context, manager *Manager, spec *CreateVolumeSpec) (string, error) {
+// CreateVolumeUtil is the helper function to create CNS volume. The volume is returned along
+// with the datastore it is created in, which differs from the datastore of spec if a create
+// task started on another datastore before the controller restarted is resumed
+func CreateVolumeUtil(ctx context.Context, manager *Manager, spec *CreateVolumeSpec) (*ics.Volume, error) {
+	ctx, cancel := withOperationTimeout(ctx, manager.CnsConfig.Global.CreateTimeout)
+	defer cancel()
 	createVolumeReq := types.VolumeReq{
-		Name:          spec.Name,
-		Size:          strconv.FormatInt(spec.CapacityGB, 10),
-		DataStoreId:   spec.DatastoreID,
-		DataStoreType: "LOCAL",
-		VolumePolicy:  "THIN",
-		Description:   "CSI Persistent Volume",
-		Bootable:      false,
-		Shared:        false,
+		Name:            spec.Name,
+		Size:            strconv.FormatFloat(MbToGb(spec.CapacityMB), 'f', -1, 64),
+		DataStoreId:     spec.DatastoreID,
+		DataStoreType:   spec.DatastoreType,
+		VolumePolicy:    spec.VolumePolicy,
+		Description:     GetVolumeDescription(spec.MaxSizeBytes),
+		StoragePolicyId: spec.StoragePolicyID,
+		Bootable:        false,
+		Shared:          false,
 	}
 
-	volumeId, err := manager.VolumeManager.CreateVolume(createVolumeReq)
+	var volume *ics.Volume
+	var err error
+	if spec.SourceVolumeID != "" {
+		volume, err = createVolumeFromSource(ctx, manager, createVolumeReq, spec)
+	} else {
+		volume, err = manager.VolumeManager.CreateVolume(ctx, createVolumeReq)
+	}
 	if err != nil {
 		klog.V(4).Infof("Failed to create volume %s with err: %v", createVolumeReq.Name, err)
-		return volumeId, err
+		return nil, err
 	} else {
-		klog.V(4).Infof("Successfully created volume %s. volumeId: %s", spec.Name, volumeId)
-		return volumeId, nil
+		klog.V(4).Infof("Successfully created volume %s. volumeId: %s datastore: %s", spec.Name, volume.ID, volume.DatastoreID)
+		return volume, nil
 	}
 }
 
+// createVolumeFromSource restores the snapshot or clones the volume in spec to a new volume
+// and expands it when a larger size than the source is requested
+func createVolumeFromSource(ctx context.Context, manager *Manager, req types.VolumeReq, spec *CreateVolumeSpec) (*ics.Volume, error) {
+	var volume *ics.Volume
+	var err error
+	if spec.SourceSnapshotID != "" {
+		volume, err = manager.VolumeManager.CreateVolumeFromSnapshot(ctx, req, spec.SourceVolumeID, spec.SourceSnapshotID)
+	} else {
+		volume, err = manager.VolumeManager.CloneVolume(ctx, req, spec.SourceVolumeID, spec.LinkedClone)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if volume.SizeGB < MbToGb(spec.CapacityMB) {
+		klog.V(4).Infof("Expanding volume %s created from volume %s from %vGB to %dMB",
+			volume.ID, spec.SourceVolumeID, volume.SizeGB, spec.CapacityMB)
+		err = manager.VolumeManager.ExpandVolume(ctx, volume.ID, MbToGb(spec.CapacityMB))
+		if err != nil {
+			return nil, err
+		}
+		volume.SizeGB = MbToGb(spec.CapacityMB)
+	}
+	return volume, nil
+}
+
 // AttachVolumeUtil is the helper function to attach CNS volume to specified vm
-func AttachVolumeUtil(ctx context.Context, manager *Manager, vm *ics.VirtualMachine, volumeId string) (string, error) {
-	diskUUID, err := manager.VolumeManager.AttachVolume(vm, volumeId)
+func AttachVolumeUtil(ctx context.Context, manager *Manager, vm *ics.VirtualMachine, volumeId string,
+	spec *ics.DiskSpec) (string, error) {
+	ctx, cancel := withOperationTimeout(ctx, manager.CnsConfig.Global.AttachTimeout)
+	defer cancel()
+	diskUUID, err := manager.VolumeManager.AttachVolume(ctx, vm, volumeId, spec)
 	if err != nil {
 		klog.Errorf("Failed to attach disk %s to VM %v with err %+v", volumeId, vm, err)
 		return "", err
@@ -62,7 +107,9 @@ func AttachVolumeUtil(ctx context.Context, manager *Manager, vm *ics.VirtualMach
 
 // DetachVolumeUtil is the helper function to detach CNS volume from specified vm
 func DetachVolumeUtil(ctx context.Context, manager *Manager, vm *ics.VirtualMachine, volumeId string) error {
-	err := manager.VolumeManager.DetachVolume(vm, volumeId)
+	ctx, cancel := withOperationTimeout(ctx, manager.CnsConfig.Global.DetachTimeout)
+	defer cancel()
+	err := manager.VolumeManager.DetachVolume(ctx, vm, volumeId)
 	if err != nil {
 		return err
 	}
@@ -72,7 +119,9 @@ func DetachVolumeUtil(ctx context.Context, manager *Manager, vm *ics.VirtualMach
 
 // DeleteVolumeUtil is the helper function to delete CNS volume for given volumeId
 func DeleteVolumeUtil(ctx context.Context, manager *Manager, volumeId string, deleteVolume bool) error {
-	err := manager.VolumeManager.DeleteVolume(volumeId, deleteVolume)
+	ctx, cancel := withOperationTimeout(ctx, manager.CnsConfig.Global.DeleteTimeout)
+	defer cancel()
+	err := manager.VolumeManager.DeleteVolume(ctx, volumeId, deleteVolume)
 	if err != nil {
 		return err
 	}
@@ -83,7 +132,9 @@ func DeleteVolumeUtil(ctx context.Context, manager *Manager, volumeId string, de
 
 // ExpandVolumeUtil is the helper function to expand CNS volume for given volumeId
 func ExpandVolumeUtil(ctx context.Context, manager *Manager, volumeId string, capacityInGb float64) error {
-	err := manager.VolumeManager.ExpandVolume(volumeId, capacityInGb)
+	ctx, cancel := withOperationTimeout(ctx, manager.CnsConfig.Global.ExpandTimeout)
+	defer cancel()
+	err := manager.VolumeManager.ExpandVolume(ctx, volumeId, capacityInGb)
 	if err != nil {
 		return err
 	}
@@ -92,6 +143,36 @@ func ExpandVolumeUtil(ctx context.Context, manager *Manager, volumeId string, ca
 	return nil
 }
 
+// CreateSnapshotUtil is the helper function to create a snapshot of CNS volume
+func CreateSnapshotUtil(ctx context.Context, manager *Manager, volumeId string, name string) (*ics.VolumeSnapshot, error) {
+	snapshot, err := manager.VolumeManager.CreateSnapshot(ctx, volumeId, name)
+	if err != nil {
+		klog.Errorf("Failed to create snapshot %s for volume %s with err: %v", name, volumeId, err)
+		return nil, err
+	}
+	klog.V(4).Infof("Successfully created snapshot %s for volume %s. snapshotId: %s", name, volumeId, snapshot.ID)
+	return snapshot, nil
+}
+
+// DeleteSnapshotUtil is the helper function to delete a snapshot of CNS volume
+func DeleteSnapshotUtil(ctx context.Context, manager *Manager, volumeId string, snapshotId string) error {
+	err := manager.VolumeManager.DeleteSnapshot(ctx, volumeId, snapshotId)
+	if err != nil {
+		return err
+	}
+	klog.V(4).Infof("Successfully deleted snapshot %s of volume %s", snapshotId, volumeId)
+	return nil
+}
+
+// withOperationTimeout bounds the context of a volume operation with its timeout in seconds.
+// The deadline of the request context still applies when it is earlier.
+func withOperationTimeout(ctx context.Context, timeoutSeconds int) (context.Context, context.CancelFunc) {
+	if timeoutSeconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+}
+
 // GetVCenter returns VirtualCenter object from specified Manager object.
 // Before returning VirtualCenter object, vcenter connection is established if session doesn't exist.
 func GetVCenter(ctx context.Context, manager *Manager) (*ics.VirtualCenter, error) {
@@ -124,6 +205,73 @@ func FormatDiskUUID(uuid string) string {
 	return strings.ToLower(uuidWithNoHypens)
 }
 
+// GetSnapshotID returns the CSI snapshot id for the given volume and iCenter snapshot id
+func GetSnapshotID(volumeId string, snapshotId string) string {
+	return volumeId + SnapshotIDSeparator + snapshotId
+}
+
+// ParseSnapshotID returns the volume id and iCenter snapshot id from the CSI snapshot id
+// Example input is 8ab0b28d77be994a0177bea19e1d0078+8ab0b28d77be994a0177bea19e1d0080
+func ParseSnapshotID(csiSnapshotId string) (string, string, error) {
+	ids := strings.Split(csiSnapshotId, SnapshotIDSeparator)
+	if len(ids) != 2 || ids[0] == "" || ids[1] == "" {
+		return "", "", fmt.Errorf("Invalid snapshot id %q", csiSnapshotId)
+	}
+	return ids[0], ids[1], nil
+}
+
+// GetVolumeDescription returns the description of a volume created by the CSI driver. The maxsize
+// of the storage class is recorded in it, as expand requests do not carry the storage class parameters
+func GetVolumeDescription(maxSizeBytes int64) string {
+	if maxSizeBytes == 0 {
+		return VolumeDescription
+	}
+	return fmt.Sprintf("%s, %s %d", VolumeDescription, AttributeMaxSize, maxSizeBytes)
+}
+
+// IsVolumeDescription tells if the description is of a volume created by the CSI driver
+func IsVolumeDescription(description string) bool {
+	return description == VolumeDescription || strings.HasPrefix(description, VolumeDescription+", ")
+}
+
+// GetVolumeMaxSize returns the maxsize in bytes recorded in the volume description, 0 if there is none
+func GetVolumeMaxSize(description string) int64 {
+	prefix := VolumeDescription + ", " + AttributeMaxSize + " "
+	if !strings.HasPrefix(description, prefix) {
+		return 0
+	}
+	maxSizeBytes, err := strconv.ParseInt(strings.TrimPrefix(description, prefix), 10, 64)
+	if err != nil {
+		klog.Warningf("Ignoring invalid %s in volume description %q", AttributeMaxSize, description)
+		return 0
+	}
+	return maxSizeBytes
+}
+
+// GetDefaultDiskFormat returns the default disk format for the given datastore type
+func GetDefaultDiskFormat(datastoreType string) string {
+	if diskFormats, ok := DatastoreTypeDiskFormats[strings.ToUpper(datastoreType)]; ok {
+		return diskFormats[0]
+	}
+	return DefaultDiskFormat
+}
+
+// IsDiskFormatSupported checks if the disk format is supported by the given datastore type.
+// All disk formats are assumed to be supported by unknown datastore types.
+func IsDiskFormatSupported(datastoreType string, diskFormat string) bool {
+	diskFormats, ok := DatastoreTypeDiskFormats[strings.ToUpper(datastoreType)]
+	if !ok {
+		klog.Warningf("Unknown datastore type %q, assuming disk format %s is supported", datastoreType, diskFormat)
+		return true
+	}
+	for _, format := range diskFormats {
+		if format == diskFormat {
+			return true
+		}
+	}
+	return false
+}
+
 // RoundUpSize calculates how many allocation units are needed to accommodate
 // a volume of given size.
 func RoundUpSize(volumeSizeBytes int64, allocationUnitBytes int64) int64 {
@@ -134,6 +282,128 @@ func RoundUpSize(volumeSizeBytes int64, allocationUnitBytes int64) int64 {
 	return roundedUp
 }
 
+// GetDiskSpec returns the disk settings given in the storage class parameters or the volume context,
+// settings which are not given have their defaults
+func GetDiskSpec(params map[string]string) (*ics.DiskSpec, error) {
+	spec := &ics.DiskSpec{
+		BusModel:  DiskBusSCSI,
+		CacheMode: DiskCacheNone,
+		QueueNum:  1,
+	}
+	for paramName, value := range params {
+		var setting *int64
+		switch param := strings.ToLower(paramName); param {
+		case AttributeBusModel:
+			// Virtio disks are not supported until the id they are exposed to nodes with
+			// is known, nodes find SCSI disks by the id iCenter reports for them.
+			spec.BusModel = strings.ToUpper(value)
+			if spec.BusModel != DiskBusSCSI {
+				return nil, fmt.Errorf("invalid %s %q, the only supported value is %q", paramName, value, DiskBusSCSI)
+			}
+			continue
+		case AttributeCacheMode:
+			spec.CacheMode = strings.ToUpper(value)
+			if spec.CacheMode != DiskCacheNone && spec.CacheMode != DiskCacheWriteBack && spec.CacheMode != DiskCacheWriteThrough {
+				return nil, fmt.Errorf("invalid %s %q, supported values are %q, %q and %q",
+					paramName, value, DiskCacheNone, DiskCacheWriteBack, DiskCacheWriteThrough)
+			}
+			continue
+		case AttributeNativeIO:
+			nativeIO, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q, must be true or false", paramName, value)
+			}
+			spec.NativeIO = nativeIO
+			continue
+		case AttributeQueueCount:
+			queueNum, err := strconv.Atoi(value)
+			if err != nil || queueNum < 1 || queueNum > MaxDiskQueueCount {
+				return nil, fmt.Errorf("invalid %s %q, must be between 1 and %d", paramName, value, MaxDiskQueueCount)
+			}
+			spec.QueueNum = queueNum
+			continue
+		case AttributeMaxIOPS:
+			setting = &spec.MaxIOPS
+		case AttributeMaxBandwidth:
+			setting = &spec.MaxBandwidthMBps
+		case AttributeBurstIOPS:
+			setting = &spec.BurstIOPS
+		case AttributeBurstBandwidth:
+			setting = &spec.BurstBandwidthMBps
+		default:
+			continue
+		}
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid %s %q, must be a non-negative integer", paramName, value)
+		}
+		*setting = limit
+	}
+	if spec.BurstIOPS != 0 && spec.BurstIOPS < spec.MaxIOPS || spec.BurstIOPS != 0 && spec.MaxIOPS == 0 {
+		return nil, fmt.Errorf("%s %d must come with a lower %s", AttributeBurstIOPS, spec.BurstIOPS, AttributeMaxIOPS)
+	}
+	if spec.BurstBandwidthMBps != 0 && spec.BurstBandwidthMBps < spec.MaxBandwidthMBps ||
+		spec.BurstBandwidthMBps != 0 && spec.MaxBandwidthMBps == 0 {
+		return nil, fmt.Errorf("%s %d must come with a lower %s",
+			AttributeBurstBandwidth, spec.BurstBandwidthMBps, AttributeMaxBandwidth)
+	}
+	// Native IO bypasses the host page cache
+	if spec.NativeIO && spec.CacheMode != DiskCacheNone {
+		return nil, fmt.Errorf("%s requires %s %q", AttributeNativeIO, AttributeCacheMode, DiskCacheNone)
+	}
+	return spec, nil
+}
+
+// SetDiskSpecAttributes adds the disk settings which are set to the attributes of a volume
+func SetDiskSpecAttributes(attributes map[string]string, spec *ics.DiskSpec) {
+	attributes[AttributeBusModel] = spec.BusModel
+	attributes[AttributeCacheMode] = spec.CacheMode
+	attributes[AttributeNativeIO] = strconv.FormatBool(spec.NativeIO)
+	attributes[AttributeQueueCount] = strconv.Itoa(spec.QueueNum)
+	settings := map[string]int64{
+		AttributeMaxIOPS:        spec.MaxIOPS,
+		AttributeMaxBandwidth:   spec.MaxBandwidthMBps,
+		AttributeBurstIOPS:      spec.BurstIOPS,
+		AttributeBurstBandwidth: spec.BurstBandwidthMBps,
+	}
+	for attribute, value := range settings {
+		if value != 0 {
+			attributes[attribute] = strconv.FormatInt(value, 10)
+		}
+	}
+}
+
+// GetErrorCode returns the gRPC code reported for an error of an iCenter operation
+func GetErrorCode(err error) codes.Code {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return codes.DeadlineExceeded
+	} else if errors.Is(err, context.Canceled) {
+		return codes.Canceled
+	}
+	switch ics.GetErrorKind(err) {
+	case ics.ErrorKindNotFound:
+		return codes.NotFound
+	case ics.ErrorKindInUse:
+		return codes.FailedPrecondition
+	case ics.ErrorKindExhausted:
+		return codes.ResourceExhausted
+	case ics.ErrorKindUnauthenticated:
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
+
+// MbToGb converts a size in mebibytes to the gibibytes iCenter expects.
+func MbToGb(sizeMB int64) float64 {
+	return float64(sizeMB) / float64(MbInGb)
+}
+
+// GbToMb converts a size in gibibytes reported by iCenter to whole mebibytes.
+func GbToMb(sizeGB float64) int64 {
+	return int64(math.Ceil(sizeGB * float64(MbInGb)))
+}
+
 // GetLabelsMapFromKeyValue creates a  map object from given parameter
 /*
 func GetLabelsMapFromKeyValue(labels []types.KeyValue) map[string]string {
@@ -162,3 +432,33 @@ func IsValidVolumeCapabilities(volCaps []*csi.VolumeCapability) bool {
 	}
 	return foundAll
 }
+
+// ValidateVolumeCapabilitiesForVolume is the helper function to validate capabilities
+// against an existing volume. Function returns error describing the first unsupported capability.
+func ValidateVolumeCapabilitiesForVolume(volCaps []*csi.VolumeCapability, shared bool) error {
+	for _, c := range volCaps {
+		if c.GetBlock() == nil && c.GetMount() == nil {
+			return fmt.Errorf("access type not specified in volume capability %+v", c)
+		}
+		if IsValidVolumeCapabilities([]*csi.VolumeCapability{c}) {
+			continue
+		}
+		supported := false
+		for _, mode := range SharedVolumeCaps {
+			if mode.GetMode() == c.GetAccessMode().GetMode() {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("access mode %s not supported", c.GetAccessMode().GetMode())
+		}
+		if !shared {
+			return fmt.Errorf("access mode %s not supported by non-shared volume", c.GetAccessMode().GetMode())
+		}
+		if c.GetBlock() == nil {
+			return fmt.Errorf("access mode %s only supported with block access type", c.GetAccessMode().GetMode())
+		}
+	}
+	return nil
+}
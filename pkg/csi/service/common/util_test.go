@@ -0,0 +1,141 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"ics-csi-driver/pkg/common/ics"
+	"reflect"
+	"testing"
+)
+
+func TestGetDiskSpec(t *testing.T) {
+	defaultSpec := ics.DiskSpec{BusModel: DiskBusSCSI, CacheMode: DiskCacheNone, QueueNum: 1}
+	tests := []struct {
+		name     string
+		params   map[string]string
+		expected *ics.DiskSpec
+	}{
+		{"defaults", nil, &defaultSpec},
+		{"settings", map[string]string{
+			"BusModel":           "scsi",
+			"CacheMode":          "writeback",
+			"QueueCount":         "4",
+			"MaxIOPS":            "1000",
+			"BurstIOPS":          "2000",
+			"MaxBandwidthMBps":   "100",
+			"BurstBandwidthMBps": "200",
+			"fstype":             "ext4",
+		}, &ics.DiskSpec{BusModel: DiskBusSCSI, CacheMode: DiskCacheWriteBack, QueueNum: 4, MaxIOPS: 1000,
+			BurstIOPS: 2000, MaxBandwidthMBps: 100, BurstBandwidthMBps: 200}},
+		{"native io", map[string]string{AttributeNativeIO: "true"},
+			&ics.DiskSpec{BusModel: DiskBusSCSI, CacheMode: DiskCacheNone, NativeIO: true, QueueNum: 1}},
+		{"virtio bus", map[string]string{AttributeBusModel: "virtio"}, nil},
+		{"invalid cache mode", map[string]string{AttributeCacheMode: "unsafe"}, nil},
+		{"invalid native io", map[string]string{AttributeNativeIO: "yes"}, nil},
+		{"native io with cache", map[string]string{AttributeNativeIO: "true", AttributeCacheMode: "writeback"}, nil},
+		{"no queue", map[string]string{AttributeQueueCount: "0"}, nil},
+		{"too many queues", map[string]string{AttributeQueueCount: fmt.Sprint(MaxDiskQueueCount + 1)}, nil},
+		{"negative limit", map[string]string{AttributeMaxIOPS: "-1"}, nil},
+		{"invalid limit", map[string]string{AttributeMaxBandwidth: "fast"}, nil},
+		{"burst without limit", map[string]string{AttributeBurstIOPS: "2000"}, nil},
+		{"burst below limit", map[string]string{AttributeMaxBandwidth: "200", AttributeBurstBandwidth: "100"}, nil},
+	}
+	for _, test := range tests {
+		spec, err := GetDiskSpec(test.params)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%s: GetDiskSpec accepted %v", test.name, test.params)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: GetDiskSpec failed with err: %v", test.name, err)
+		} else if !reflect.DeepEqual(spec, test.expected) {
+			t.Errorf("%s: GetDiskSpec = %v, want %v", test.name, spec, test.expected)
+		}
+	}
+}
+
+func TestParseSnapshotID(t *testing.T) {
+	tests := []struct {
+		csiSnapshotID string
+		volumeID      string
+		snapshotID    string
+		valid         bool
+	}{
+		{GetSnapshotID("volume-1", "snapshot-1"), "volume-1", "snapshot-1", true},
+		{"volume-1", "", "", false},
+		{"volume-1+", "", "", false},
+		{"+snapshot-1", "", "", false},
+		{"volume-1+snapshot-1+snapshot-2", "", "", false},
+	}
+	for _, test := range tests {
+		volumeID, snapshotID, err := ParseSnapshotID(test.csiSnapshotID)
+		if (err == nil) != test.valid {
+			t.Errorf("ParseSnapshotID(%q) returned err: %v", test.csiSnapshotID, err)
+		} else if volumeID != test.volumeID || snapshotID != test.snapshotID {
+			t.Errorf("ParseSnapshotID(%q) = %q, %q, want %q, %q",
+				test.csiSnapshotID, volumeID, snapshotID, test.volumeID, test.snapshotID)
+		}
+	}
+}
+
+func TestGetErrorCode(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected codes.Code
+	}{
+		{fmt.Errorf("Waiting for task failed: %w", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{context.Canceled, codes.Canceled},
+		{ics.NewError(ics.ErrorKindNotFound, "Volume not found"), codes.NotFound},
+		{ics.NewError(ics.ErrorKindInUse, "Volume is attached to another VM"), codes.FailedPrecondition},
+		{errors.New("No free slot for the disk"), codes.ResourceExhausted},
+		{ics.NewError(ics.ErrorKindUnauthenticated, "Session expired"), codes.Unavailable},
+		{errors.New("Task state FAILED"), codes.Internal},
+	}
+	for _, test := range tests {
+		if code := GetErrorCode(test.err); code != test.expected {
+			t.Errorf("GetErrorCode(%v) = %v, want %v", test.err, code, test.expected)
+		}
+	}
+}
+
+func TestGetVolumeMaxSize(t *testing.T) {
+	tests := []struct {
+		description string
+		driver      bool
+		expected    int64
+	}{
+		{GetVolumeDescription(0), true, 0},
+		{GetVolumeDescription(2 * GbInBytes), true, 2 * GbInBytes},
+		{VolumeDescription + ", maxsize large", true, 0},
+		{"CSI Persistent Volumes", false, 0},
+		{"maxsize 1024", false, 0},
+	}
+	for _, test := range tests {
+		if driver := IsVolumeDescription(test.description); driver != test.driver {
+			t.Errorf("IsVolumeDescription(%q) = %v, want %v", test.description, driver, test.driver)
+		}
+		if maxSizeBytes := GetVolumeMaxSize(test.description); maxSizeBytes != test.expected {
+			t.Errorf("GetVolumeMaxSize(%q) = %d, want %d", test.description, maxSizeBytes, test.expected)
+		}
+	}
+}
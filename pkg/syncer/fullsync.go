@@ -17,6 +17,7 @@ limitations under the License.
 package syncer
 
 import (
+	"context"
 	"github.com/davecgh/go-spew/spew"
 	"ics-csi-driver/pkg/common/ics"
 	cnstypes "ics-csi-driver/pkg/common/types"
@@ -207,7 +208,7 @@ func fullSyncDeleteVolumes(volumeIDDeleteArray []string, metadataSyncer *Metadat
 		// Delete volume if not present in currentK8sPVMap
 		if _, existsInK8s := currentK8sPVMap[volID]; !existsInK8s {
 			klog.V(4).Infof("Calling DeleteVolume for volume %s with delete disk %v", volID, deleteDisk)
-			err := ics.GetVolumeManager(metadataSyncer.vcenter).DeleteVolume(volID, deleteDisk)
+			err := ics.GetVolumeManager(metadataSyncer.vcenter, ics.VolumeManagerOptions{}).DeleteVolume(context.Background(), volID, deleteDisk)
 			if err != nil {
 				klog.Warningf("Failed to delete volume %s with error %+v", volID, err)
 				continue
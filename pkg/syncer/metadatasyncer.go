@@ -387,7 +387,7 @@ func pvDeleted(obj interface{}, metadataSyncer *MetadataSyncInformer) {
 	volumeOperationsLock.Lock()
 	defer volumeOperationsLock.Unlock()
 	klog.V(4).Infof("PVDeleted: Deleting PV %s Id %s  with deleteDisk %v", pv.Name, pv.Spec.CSI.VolumeHandle, deleteDisk)
-	if err := ics.GetVolumeManager(metadataSyncer.vcenter).DeleteVolume(pv.Spec.CSI.VolumeHandle, deleteDisk); err != nil {
+	if err := ics.GetVolumeManager(metadataSyncer.vcenter, ics.VolumeManagerOptions{}).DeleteVolume(context.Background(), pv.Spec.CSI.VolumeHandle, deleteDisk); err != nil {
 		klog.Errorf("PVDeleted: Failed to delete PV %s Id %s with error %+v", pv.Name, pv.Spec.CSI.VolumeHandle, err)
 		return
 	}